@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// defaultMembersGroup is the gerrit group (non guest) users are placed in, unless configured otherwise
+const defaultMembersGroup = "team-members"
+
+// accountLinker links users to their gerrit accounts (whose username is the users login), creating the
+// accounts of users that do not have one yet
+type accountLinker struct {
+	db        *gorm.DB
+	gerritCfg GerritConfig
+}
+
+// newAccountLinker returns an accountLinker for the gerrit server in the config
+func newAccountLinker(db *gorm.DB, gerritCfg GerritConfig) *accountLinker {
+	return &accountLinker{
+		db:        db,
+		gerritCfg: gerritCfg,
+	}
+}
+
+// OnLogin is a LoginHook that provisions (or links) the gerrit account of users that are not yet linked to
+// one, and records its ID. Failures are logged, but do not prevent the login (provisioning will be retried on
+// the next login).
+func (l *accountLinker) OnLogin(ctx context.Context, tok *oauth2.Token, ident *Identity, user *datastore.User) error {
+	if user.GerritAccountID != 0 {
+		return nil
+	}
+	if err := l.Provision(ident, user); err != nil {
+		log.Println("Failed to provision gerrit account for", user.Username, ":", err)
+	}
+	return nil
+}
+
+// Provision creates the gerrit account of the user (using their login, name and verified email) unless it
+// already exists, places members in the members group and links the account to the user. An existing account
+// is only linked if its email is the users verified email, and the account frontman administers gerrit with
+// is never linked.
+func (l *accountLinker) Provision(ident *Identity, user *datastore.User) error {
+	if strings.EqualFold(user.Username, l.gerritCfg.Username) {
+		return errors.Errorf("refusing to link the gerrit admin account %s", l.gerritCfg.Username)
+	}
+	gclt, err := l.gerritCfg.NewClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to setup client to gerrit server")
+	}
+
+	group := l.gerritCfg.MembersGroup
+	if group == "" {
+		group = defaultMembersGroup
+	}
+	isMember := false
+	for _, mem := range ident.Memberships {
+		isMember = isMember || mem.Role != RoleGuest
+	}
+
+	acct, resp, err := gclt.Accounts.GetAccount(user.Username)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		input := gerrit.AccountInput{Name: ident.Name, Email: ident.Email}
+		if input.Name == "" {
+			input.Name = ident.Login
+		}
+		if isMember {
+			input.Groups = []string{group}
+		}
+		log.Println("Creating gerrit account for", user.Username)
+		if acct, _, err = gclt.Accounts.CreateAccount(user.Username, &input); err != nil {
+			return errors.Wrap(err, "failed to create gerrit account")
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "failed to lookup gerrit account")
+	} else if ident.Email == "" || !strings.EqualFold(acct.Email, ident.Email) {
+		return errors.Errorf("refusing to link existing gerrit account %s, its email does not match", user.Username)
+	} else if isMember {
+		if _, _, err := gclt.Groups.AddGroupMember(group, user.Username); err != nil {
+			return errors.Wrapf(err, "failed to add %s to gerrit group %s", user.Username, group)
+		}
+	}
+
+	log.Println("Linking", user.Username, "to gerrit account", acct.AccountID)
+	user.GerritAccountID = acct.AccountID
+	return datastore.UpsertUser(l.db, user)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+)
+
+func TestProvision(t *testing.T) {
+	member := []Membership{{Org: "acme", Role: RoleMember}}
+	tests := []struct {
+		name        string
+		username    string
+		email       string
+		existing    map[string]interface{} // the gerrit account that exists already
+		wantChanges []string
+		wantAccount int // 0 if the user must not be linked
+	}{
+		{
+			name:        "new account",
+			username:    "newbie",
+			email:       "newbie@example.com",
+			wantChanges: []string{"PUT /accounts/newbie"},
+			wantAccount: 2000,
+		},
+		{
+			name:        "existing account",
+			username:    "veteran",
+			email:       "Veteran@example.com",
+			existing:    map[string]interface{}{"_account_id": 1000, "email": "veteran@example.com"},
+			wantChanges: []string{"PUT /groups/team-members/members/veteran"},
+			wantAccount: 1000,
+		},
+		{
+			name:     "existing account with another email",
+			username: "squatted",
+			email:    "squatted@example.com",
+			existing: map[string]interface{}{"_account_id": 1001, "email": "someone-else@example.com"},
+		},
+		{
+			name:     "existing account without verified email",
+			username: "unverified",
+			existing: map[string]interface{}{"_account_id": 1002, "email": "unverified@example.com"},
+		},
+		{
+			name:     "admin account",
+			username: "Admin",
+			email:    "admin@example.com",
+			existing: map[string]interface{}{"_account_id": 1, "email": "admin@example.com"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			gerrit := newFakeGerrit()
+			srv := httptest.NewServer(gerrit)
+			defer srv.Close()
+			if tc.existing != nil {
+				gerrit.accounts[tc.username] = tc.existing
+			}
+
+			user := datastore.User{Username: tc.username, GithubID: 1}
+			if err := datastore.InsertUser(db, &user); err != nil {
+				t.Fatalf("failed to insert user: %v", err)
+			}
+			l := newAccountLinker(db, GerritConfig{Addr: srv.URL, Username: "admin", Password: "secret"})
+			err := l.Provision(&Identity{Login: tc.username, Email: tc.email, Memberships: member}, &user)
+			if (err == nil) != (tc.wantAccount != 0) {
+				t.Errorf("unexpected provisioning result: %v", err)
+			}
+
+			if got := gerrit.changes(); !reflect.DeepEqual(got, append([]string{}, tc.wantChanges...)) {
+				t.Errorf("expected changes %q, got %q", tc.wantChanges, got)
+			}
+			found, _ := datastore.FindUserByID(db, user.ID)
+			if found.GerritAccountID != tc.wantAccount {
+				t.Errorf("expected user linked to account %d, got %d", tc.wantAccount, found.GerritAccountID)
+			}
+		})
+	}
+}
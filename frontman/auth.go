@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 
+	"github.com/amoghe/polly/frontman/datastore"
 	"github.com/google/go-github/github"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 
 	goji "goji.io"
@@ -23,72 +30,233 @@ var (
 	GithubAuthURL = "https://github.com/login/oauth/authorize"
 	// GithubTokenURL is the URL at which we get the token
 	GithubTokenURL = "https://github.com/login/oauth/access_token"
-	// DefaultScopes represents the minimum scope we need to operate
+	// githubAuthPath and githubTokenPath are the oauth2 endpoints (relative to a Github Enterprise instance)
+	githubAuthPath  = "/login/oauth/authorize"
+	githubTokenPath = "/login/oauth/access_token"
+	// DefaultScopes represents the minimum scope we need to operate (used unless scopes are configured)
 	DefaultScopes = []github.Scope{github.ScopeReadPublicKey, github.ScopeReadOrg}
+	// impliedScopes lists the (broader) scopes that also grant a given scope
+	impliedScopes = map[github.Scope][]github.Scope{
+		github.ScopeReadOrg:       {github.ScopeWriteOrg, github.ScopeAdminOrg},
+		github.ScopeReadPublicKey: {github.ScopeWritePublicKey, github.ScopeAdminPublicKey},
+		github.ScopePublicRepo:    {github.ScopeRepo},
+	}
+
+	// errInvalidSession is returned when the session cookie fails decryption or decoding
+	errInvalidSession = errors.New("invalid session")
+	// errMissingScopes is returned when the token of the session lacks (newly) required scopes, the user needs
+	// to login again to grant them
+	errMissingScopes = errors.New("session is missing required scopes, please login again")
+	// errOffboarded is returned for users who were offboarded (left the allowed orgs)
+	errOffboarded = errors.New("user has been offboarded")
 )
 
+// The login, callback, token and verify routes are relative to the identity providers name (e.g. the login
+// route for Github is /github/login).
 const (
-	// RouteLogin is used for Github OAuth2 login flow
-	RouteLogin = "/github/login"
-	// RouteCallback is used for the Github OAuth2 callback
-	RouteCallback = "/github/callback"
-	// RouteBackdoor is used to set session cookie for a given PAT
-	RouteBackdoor = "/github/backdoor"
+	// RouteLogin is used for OAuth2 login flow
+	RouteLogin = "/login"
+	// RouteCallback is used for the OAuth2 callback
+	RouteCallback = "/callback"
+	// RouteTokenLogin is used to set session cookie for a given personal access token
+	RouteTokenLogin = "/token"
 	// RouteVerify is used to verify the is the token in the session is ok
-	RouteVerify = "/github/verify"
+	RouteVerify = "/verify"
 	// RouteLogout is the route to logout
 	RouteLogout = "/logout"
+
+	// defaultLoginReturnTo is where users are sent after login, unless they asked for something else (only
+	// Github users have organizations to look at, everyone else goes home)
+	defaultLoginReturnTo = "/github/organizations"
+
+	// sessionAccessTokenSealName and sessionRefreshTokenSealName are what the upstream tokens of sessions are
+	// sealed for (like cookie names)
+	sessionAccessTokenSealName  = "session-access-token"
+	sessionRefreshTokenSealName = "session-refresh-token"
 )
 
 // GithubConfig holds the config for our Github app
 type GithubConfig struct {
-	OrgName  string
+	Orgs     []GithubOrg
 	ClientID string
 	Secret   string
+	// URL is the (web) URL of the Github Enterprise instance, leave empty for github.com
+	URL string
+	// APIURL is the API URL of the Github Enterprise instance, defaults to URL + "/api/v3/"
+	APIURL string
+	// Scopes are the scopes requested at login (and required of tokens), defaults to DefaultScopes
+	Scopes []github.Scope
+	// ServiceToken is the token of a (bot) account that background jobs act as, it must be able to see the
+	// (concealed) members of the orgs
+	ServiceToken string
+	// DeployToken is the token used to replicate changes back to Github (defaults to the ServiceToken), it
+	// must be able to push to the imported repositories
+	DeployToken string
+	// WebhookSecret is the secret Github signs webhook events with (pushes are only mirrored into gerrit if set)
+	WebhookSecret string
+}
+
+// GithubOrg is an org whose (active) members are allowed to use polly, with the role they are granted
+type GithubOrg struct {
+	Name string
+	Role string
+}
+
+// RequiredScopes returns the configured scopes, or the DefaultScopes if none are configured
+func (c GithubConfig) RequiredScopes() []github.Scope {
+	if len(c.Scopes) <= 0 {
+		return DefaultScopes
+	}
+	return c.Scopes
+}
+
+// NewServiceClient returns a github.Client that acts as the service account (or an unauthenticated one, if
+// there is no service token)
+func (c GithubConfig) NewServiceClient(ctx context.Context) (*github.Client, error) {
+	if c.ServiceToken == "" {
+		return c.NewClient(nil)
+	}
+	return c.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: c.ServiceToken})))
+}
+
+// ReplicationToken returns the token used to push to Github
+func (c GithubConfig) ReplicationToken() string {
+	if c.DeployToken != "" {
+		return c.DeployToken
+	}
+	return c.ServiceToken
+}
+
+// OAuth2Endpoint returns the oauth2 endpoints of github.com or the Github Enterprise instance
+func (c GithubConfig) OAuth2Endpoint() oauth2.Endpoint {
+	if c.URL == "" {
+		return oauth2.Endpoint{AuthURL: GithubAuthURL, TokenURL: GithubTokenURL}
+	}
+	base := strings.TrimSuffix(c.URL, "/")
+	return oauth2.Endpoint{AuthURL: base + githubAuthPath, TokenURL: base + githubTokenPath}
+}
+
+// NewClient returns a github.Client (using the given http.Client) that talks to github.com or the Github
+// Enterprise instance.
+func (c GithubConfig) NewClient(httpClient *http.Client) (*github.Client, error) {
+	client := github.NewClient(httpClient)
+	if c.URL == "" && c.APIURL == "" {
+		return client, nil
+	}
+
+	apiURL := c.APIURL
+	if apiURL == "" {
+		apiURL = strings.TrimSuffix(c.URL, "/") + "/api/v3/"
+	}
+	if !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+	baseURL, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid github API URL")
+	}
+	uploadURL := baseURL // we don't upload anything, but keep the client off github.com regardless
+	if c.URL != "" {
+		uploadURL, err = url.Parse(strings.TrimSuffix(c.URL, "/") + "/api/uploads/")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid github upload URL")
+	}
+	client.BaseURL = baseURL
+	client.UploadURL = uploadURL
+	return client, nil
+}
+
+// AuthConfig holds the settings for authenticating users and their sessions
+type AuthConfig struct {
+	// Provider is the name of the IdentityProvider users authenticate with (github, gitlab or oidc)
+	Provider string
+	// Gitlab holds the settings for the gitlab IdentityProvider
+	Gitlab GitlabConfig
+	// OIDC holds the settings for the oidc IdentityProvider
+	OIDC OIDCConfig
+	// BaseURL is the externally visible URL of frontman, the OAuth2 callback URL, redirects and cookie
+	// settings are derived from it
+	BaseURL string
+	// SessionKeys are used to encrypt and authenticate the session cookie (the first one is used for new
+	// sessions, the rest are only accepted when verifying existing ones)
+	SessionKeys [][]byte
+	// AllowTokenLogin enables logging in using a personal access token (for non-browser clients)
+	AllowTokenLogin bool
+	// VerifyCacheTTL is how long successful token verifications are cached for
+	VerifyCacheTTL time.Duration
+	// VerifyCacheNegativeTTL is how long failed token verifications are cached for
+	VerifyCacheNegativeTTL time.Duration
+	// APITokenMaxTTL is the longest an API token may be valid for (and how long it is valid for if the user
+	// doesn't say), defaults to defaultAPITokenMaxTTL
+	APITokenMaxTTL time.Duration
 }
 
 // AuthenticatingRouter is an http.Handler that can additionally return the github.Client for the currently
 // authenticated user (based on the oauth token saved in the session state)
 type AuthenticatingRouter interface {
 	AuthTokenFromRequest(*http.Request) (*oauth2.Token, error)
+	Authenticate(*http.Request) (*RequestIdentity, error)
+	VerifyAuthToken(oauth2.Token) (*Identity, error)
+	LoginURL(returnTo string) string
 	http.Handler
 }
 
 // authRouter is the mux that handles all auth related routes
 type authRouter struct {
 	mux                *goji.Mux
-	oauth2Config       oauth2.Config
-	githubConfig       GithubConfig
+	db                 *gorm.DB
+	baseURL            *url.URL
+	provider           IdentityProvider
+	authConfig         AuthConfig
 	stateCookieMaker   CookieMaker
 	sessionCookieMaker CookieMaker
+	sessionSealer      *cookieSealer
+	verifyCache        *verificationCache
+	loginHooks         []LoginHook
 }
 
-// NewAuthRouter returns a http.Handler that handles routes pertaining to authentication
-func NewAuthRouter(githubCfg GithubConfig) AuthenticatingRouter {
-	scopes := make([]string, len(DefaultScopes))
-	for _, scope := range DefaultScopes {
-		scopes = append(scopes, string(scope))
+// NewAuthRouter returns a http.Handler that handles routes pertaining to authentication. The hooks are run
+// whenever a user logs in.
+func NewAuthRouter(db *gorm.DB, githubCfg GithubConfig, authCfg AuthConfig, hooks ...LoginHook) (AuthenticatingRouter, error) {
+	baseURL, err := parseBaseURL(authCfg.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	providerName := authCfg.Provider
+	if providerName == "" {
+		providerName = ProviderGithub
 	}
-	oauth2Cfg := oauth2.Config{
-		ClientID:     githubCfg.ClientID,
-		ClientSecret: githubCfg.Secret,
-		RedirectURL:  "http://localhost:8080/auth" + RouteCallback,
-		Endpoint:     oauth2.Endpoint{AuthURL: GithubAuthURL, TokenURL: GithubTokenURL},
-		Scopes:       scopes,
+	provider, err := NewIdentityProvider(authCfg, githubCfg, resolveURL(baseURL, "/auth/"+providerName+RouteCallback))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to setup identity provider")
+	}
+	sealer, err := newCookieSealer(authCfg.SessionKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to setup session cookie encryption")
 	}
 	a := authRouter{
 		mux:                goji.SubMux(),
-		githubConfig:       githubCfg,
-		oauth2Config:       oauth2Cfg,
-		stateCookieMaker:   stateCookieMaker,
-		sessionCookieMaker: sessionCookieMaker,
+		db:                 db,
+		baseURL:            baseURL,
+		provider:           provider,
+		authConfig:         authCfg,
+		stateCookieMaker:   stateCookieMaker.ForBaseURL(baseURL),
+		sessionCookieMaker: sessionCookieMaker.ForBaseURL(baseURL),
+		sessionSealer:      sealer,
+		verifyCache:        newVerificationCache(authCfg.VerifyCacheTTL, authCfg.VerifyCacheNegativeTTL),
+		loginHooks:         hooks,
 	}
-	a.mux.HandleFunc(pat.Get(RouteLogin), a.HandleLogin)
-	a.mux.HandleFunc(pat.Get(RouteCallback), a.HandleCallback)
+	prefix := "/" + provider.Name()
+	a.mux.HandleFunc(pat.Get(prefix+RouteLogin), a.HandleLogin)
+	a.mux.HandleFunc(pat.Get(prefix+RouteCallback), a.HandleCallback)
 	a.mux.HandleFunc(pat.Post(RouteLogout), a.HandleLogout)
-	a.mux.HandleFunc(pat.Get(RouteBackdoor), a.HandleBackdoor)
-	a.mux.HandleFunc(pat.Get(RouteVerify), a.HandleVerify)
-	return &a
+	if authCfg.AllowTokenLogin {
+		a.mux.HandleFunc(pat.Post(prefix+RouteTokenLogin), a.HandleTokenLogin)
+	}
+	a.mux.HandleFunc(pat.Get(prefix+RouteVerify), a.HandleVerify)
+	a.registerTokenRoutes(newAuthenticator(&a, githubCfg, authCfg))
+	return &a, nil
 }
 
 // ServeHTTP allows authRouter satisfy the http.Handler interface
@@ -98,40 +266,80 @@ func (a *authRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // sessionState is what we store in the session to keep track of the user
 type sessionState struct {
-	//UserID      int
+	SessionID   string
+	UserID      uint
 	OAuth2Token oauth2.Token
+	Memberships []Membership
+	Scopes      []string  // scopes granted to the token (empty for API tokens and old sessions)
+	ExpiresAt   time.Time // zero if it does not expire
+}
+
+// oauthState is what we store in the state cookie for the duration of the oauth2 round trip
+type oauthState struct {
+	State    string
+	ReturnTo string
 }
 
-// HandleLogout destroys the session on POSTs and redirects to home.
+// HandleLogout revokes the session on POSTs and redirects to home.
 func (a *authRouter) HandleLogout(w http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
-		sessionStore.Destroy(w, a.sessionCookieMaker.Name)
+		if err := a.clearSessionState(w, req); err != nil {
+			handleInternalError(w, errors.Wrap(err, "failed to revoke session"))
+			return
+		}
 	}
-	http.Redirect(w, req, "/", http.StatusFound)
+	http.Redirect(w, req, resolveURL(a.baseURL, "/"), http.StatusFound)
 }
 
-// HandleLogin starts the OAuth login process
+// HandleLogin starts the OAuth login process. The (optional) return_to query param specifies the (frontman
+// relative) path to send the user to once they are logged in.
 func (a *authRouter) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	returnTo := a.defaultReturnTo()
+	if raw := r.URL.Query().Get("return_to"); raw != "" {
+		if !isSafeReturnTo(raw) {
+			handleMissingParam(w, errors.Errorf("invalid return_to path: %s", raw))
+			return
+		}
+		returnTo = raw
+	}
 
 	state, err := a.getSessionState(r)
 	if err != nil {
-		randomState := a.setRandomState(w)
-		http.Redirect(w, r, a.oauth2Config.AuthCodeURL(randomState), http.StatusFound)
+		a.redirectToAuthCodeURL(w, r, returnTo)
 		return
 	}
 
-	auth, err := a.VerifyAuthToken(state.OAuth2Token)
+	ident, err := a.VerifyAuthToken(state.OAuth2Token)
 	if err != nil {
-		randomState := a.setRandomState(w)
-		http.Redirect(w, r, a.oauth2Config.AuthCodeURL(randomState), http.StatusFound)
+		a.redirectToAuthCodeURL(w, r, returnTo)
+		return
+	}
+	if err := a.provider.CheckScopes(state.Scopes); err != nil {
+		log.Println("Sending", ident.Login, "through re-consent:", err)
+		a.redirectToAuthCodeURL(w, r, returnTo)
 		return
 	}
-	log.Println("auth is:", auth)
+	log.Println("Already logged in:", ident.Login)
 
-	// TODO: check auth.Scopes for sufficient permissions
+	http.Redirect(w, r, resolveURL(a.baseURL, returnTo), http.StatusFound)
+}
 
-	// TODO: where to redirect when user is already authenticated?
-	http.Redirect(w, r, "/", http.StatusFound)
+// defaultReturnTo returns the path users are sent to after login, unless they asked for something else
+func (a *authRouter) defaultReturnTo() string {
+	if a.provider.Name() != ProviderGithub {
+		return "/"
+	}
+	return defaultLoginReturnTo
+}
+
+// redirectToAuthCodeURL sends the user to the identity provider to authorize us, remembering where to send them afterwards
+func (a *authRouter) redirectToAuthCodeURL(w http.ResponseWriter, r *http.Request, returnTo string) {
+	randomState, err := a.setRandomState(w, returnTo)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to save oauth2 state"))
+		return
+	}
+	http.Redirect(w, r, a.provider.LoginURL(randomState), http.StatusFound)
 }
 
 // HandleCallback handles the outh callback
@@ -143,11 +351,13 @@ func (a *authRouter) HandleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	randState1, err := a.getRandomState(r)
+	oauthState, err := a.getRandomState(r)
 	if err != nil {
 		handleUnauthorized(w, "failed to extract random CSRF state (oauth2 callback)")
 		return
 	}
+	a.clearRandomState(w)
+	randState1 := oauthState.State
 	randState2 := r.Form.Get("state")
 	if randState2 == "" {
 		handleUnauthorized(w, "request missing code or state (oauth2 callback)")
@@ -158,68 +368,108 @@ func (a *authRouter) HandleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authCode := r.Form.Get("code") // Github docs say this is the code
-	token, err := a.oauth2Config.Exchange(r.Context(), authCode)
+	authCode := r.Form.Get("code") // OAuth2 spec says this is the code
+	token, err := a.provider.Exchange(r.Context(), authCode)
 	if err != nil {
 		handleUnauthorized(w, "failed to exchange token (oauth2 callback)")
 		return
 	}
 
-	_, err = a.VerifyAuthToken(*token)
+	ident, err := a.VerifyAuthToken(*token)
 	if err != nil {
 		handleUnauthorized(w, err.Error())
 		return
 	}
+	user, err := a.saveUser(ident)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to save user"))
+		return
+	}
+	if err := a.runLoginHooks(r.Context(), token, ident, user); err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to complete login"))
+		return
+	}
 
-	state := sessionState{OAuth2Token: *token}
-	a.setSessionState(w, state)
+	state := sessionState{UserID: user.ID, OAuth2Token: *token, Memberships: ident.Memberships, Scopes: ident.Scopes}
+	if err := a.setSessionState(w, state); err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to save session"))
+		return
+	}
 
-	// TODO: send them to their "homepage"
-	http.Redirect(w, r, "/github/organizations", http.StatusFound)
+	// the return_to path was validated before it was sealed in the state cookie, re-check regardless
+	returnTo := oauthState.ReturnTo
+	if !isSafeReturnTo(returnTo) {
+		returnTo = a.defaultReturnTo()
+	}
+	http.Redirect(w, r, resolveURL(a.baseURL, returnTo), http.StatusFound)
 }
 
-//HandleBackdoor sets the session cookie for the given username+password (provided via BasicAuth)
-func (a *authRouter) HandleBackdoor(w http.ResponseWriter, r *http.Request) {
-	user, pass, ok := r.BasicAuth()
-	if !ok {
-		handleMissingParam(w, errors.New("missing auth credentials"))
-		return
-	}
-	if len(user) <= 0 || len(pass) <= 0 {
-		handleMissingParam(w, errors.New("username/password too short"))
+// HandleTokenLogin sets the session cookie for the given personal access token (issued by the provider). The
+// token is read from the Authorization header ("token <PAT>" or "Bearer <PAT>") or from the "access_token"
+// form value.
+func (a *authRouter) HandleTokenLogin(w http.ResponseWriter, r *http.Request) {
+	accessToken := personalAccessTokenFromRequest(r)
+	if len(accessToken) <= 0 {
+		handleMissingParam(w, errors.New("missing personal access token"))
 		return
 	}
 
-	log.Println("[BACKDOOR] Attempting to create authorization for", user)
-	authNote := "polly-backdoor"
-	baTransp := github.BasicAuthTransport{
-		Username: user,
-		Password: pass,
+	token := oauth2.Token{AccessToken: accessToken}
+	ident, err := a.VerifyAuthToken(token)
+	if err != nil {
+		log.Println("[TOKEN-LOGIN] token verification error:", err)
+		handleUnauthorized(w, fmt.Sprintf("failed to verify token: %s", err.Error()))
+		return
 	}
-	ghClient := github.NewClient(baTransp.Client())
-	auth, _, err := ghClient.Authorizations.Create(&github.AuthorizationRequest{
-		Scopes:       DefaultScopes,
-		Note:         &authNote,
-		ClientID:     &a.githubConfig.ClientID,
-		ClientSecret: &a.githubConfig.Secret,
-	})
+	user, err := a.saveUser(ident)
 	if err != nil {
-		log.Println("[BACKDOOR] api error:", err)
-		handleGithubAPIError(w, err)
+		handleInternalError(w, errors.Wrap(err, "failed to save user"))
+		return
+	}
+	if err := a.runLoginHooks(r.Context(), &token, ident, user); err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to complete login"))
 		return
 	}
 
-	token := oauth2.Token{AccessToken: *auth.Token}
-	_, err = a.VerifyAuthToken(token)
-	if err != nil {
-		log.Println("[BACKDOOR] token verification error:", err)
-		handleGithubAPIError(w, err)
+	state := sessionState{UserID: user.ID, OAuth2Token: token, Memberships: ident.Memberships, Scopes: ident.Scopes}
+	if err := a.setSessionState(w, state); err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to save session"))
 		return
 	}
+	log.Printf("[TOKEN-LOGIN] Issued session for user %s", ident.Login)
+}
 
-	state := sessionState{OAuth2Token: token}
-	a.setSessionState(w, state)
-	log.Printf("[BACKDOOR] Issued session for user %s", user)
+// saveUser records the (freshly logged in) user in the datastore
+func (a *authRouter) saveUser(ident *Identity) (*datastore.User, error) {
+	user := datastore.User{
+		Provider:    ident.Provider,
+		Subject:     ident.Subject,
+		Username:    ident.Login,
+		Name:        ident.Name,
+		Email:       ident.Email,
+		LastLoginAt: time.Now(),
+	}
+	if ident.Provider == ProviderGithub {
+		githubID, err := strconv.Atoi(ident.Subject)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid github user ID")
+		}
+		user.GithubID = githubID
+	}
+	if err := datastore.UpsertUser(a.db, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// runLoginHooks runs the login hooks (in order) for the freshly logged in user
+func (a *authRouter) runLoginHooks(ctx context.Context, tok *oauth2.Token, ident *Identity, user *datastore.User) error {
+	for _, hook := range a.loginHooks {
+		if err := hook(ctx, tok, ident, user); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // HandleVerify verifies whether the token in the session associated with the request is valid
@@ -229,12 +479,12 @@ func (a *authRouter) HandleVerify(w http.ResponseWriter, r *http.Request) {
 		handleUnauthorized(w, "missing auth token or session")
 		return
 	}
-	auth, err := a.VerifyAuthToken(*tok)
+	ident, err := a.VerifyAuthToken(*tok)
 	if err != nil {
 		handleUnauthorized(w, fmt.Sprintf("failed to verify token: %s", err.Error()))
 		return
 	}
-	log.Println("[BACKDOOR] verified token (last 8)", *auth.TokenLastEight)
+	log.Println("[VERIFY] verified token for user", ident.Login)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -242,105 +492,327 @@ func (a *authRouter) HandleVerify(w http.ResponseWriter, r *http.Request) {
 // - - - Helpers - - -
 //
 
-// hasSessionState returns true if the user has a cookie containing session state.
+// hasSessionState returns true if the user has a cookie containing (valid) session state.
 func (a *authRouter) hasSessionState(req *http.Request) bool {
-	if _, err := sessionStore.Get(req, a.sessionCookieMaker.Name); err == nil {
+	if _, err := a.getSessionState(req); err == nil {
 		return true
 	}
 	return false
 }
 
-// generate random state and set it in the request (cookie) as well as return it
-func (a *authRouter) setRandomState(w http.ResponseWriter) string {
+// generate random state and set it (along with the return_to path) in the (encrypted) state cookie as well
+// as return it
+func (a *authRouter) setRandomState(w http.ResponseWriter, returnTo string) (string, error) {
 	rnd := make([]byte, 32)
-	rand.Read(rnd)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", err
+	}
 
-	val := base64.StdEncoding.EncodeToString(rnd)
-	http.SetCookie(w, a.stateCookieMaker.NewCookie(val))
+	st := oauthState{
+		State:    base64.RawURLEncoding.EncodeToString(rnd),
+		ReturnTo: returnTo,
+	}
+	val, err := json.Marshal(&st)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := a.sessionSealer.Seal(a.stateCookieMaker.Name, val)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, a.stateCookieMaker.NewCookie(sealed))
 
-	return val
+	return st.State, nil
 }
 
-// get the random state value from the cookie (we set earlier)
-func (a *authRouter) getRandomState(r *http.Request) (string, error) {
+// get the random state (and return_to path) from the cookie (we set earlier)
+func (a *authRouter) getRandomState(r *http.Request) (oauthState, error) {
 	stateCookie, err := r.Cookie(a.stateCookieMaker.Name)
 	if err != nil {
-		return "", err
+		return oauthState{}, err
 	}
-	return stateCookie.Value, err
+	dec, err := a.sessionSealer.Open(a.stateCookieMaker.Name, stateCookie.Value)
+	if err != nil {
+		return oauthState{}, err
+	}
+	st := oauthState{}
+	if err := json.Unmarshal(dec, &st); err != nil {
+		return oauthState{}, err
+	}
+	return st, nil
+}
+
+// clear the random state (it is single use) by expiring the state cookie
+func (a *authRouter) clearRandomState(w http.ResponseWriter) {
+	cookie := a.stateCookieMaker.NewCookie("")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
 }
 
-// set the session state (user ID and auth token) in the session cookie
+// set the session state (user ID and auth token) by persisting it in a new server side session, whose
+// (opaque) ID is stored in the (encrypted) session cookie
 func (a *authRouter) setSessionState(w http.ResponseWriter, sc sessionState) error {
-	val, err := json.Marshal(&sc)
+	rnd := make([]byte, 32)
+	if _, err := rand.Read(rnd); err != nil {
+		return errors.Wrap(err, "failed to generate session ID")
+	}
+
+	mems, err := json.Marshal(sc.Memberships)
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := a.sessionSealer.SealToken(sessionAccessTokenSealName, sc.OAuth2Token.AccessToken)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := a.sessionSealer.SealToken(sessionRefreshTokenSealName, sc.OAuth2Token.RefreshToken)
 	if err != nil {
 		return err
 	}
-	b64 := base64.URLEncoding.EncodeToString(val)
-	http.SetCookie(w, a.sessionCookieMaker.NewCookie(b64))
+
+	now := time.Now()
+	session := datastore.Session{
+		ID:           base64.RawURLEncoding.EncodeToString(rnd),
+		UserID:       sc.UserID,
+		Memberships:  string(mems),
+		Scopes:       strings.Join(sc.Scopes, ","),
+		AccessToken:  accessToken,
+		TokenType:    sc.OAuth2Token.TokenType,
+		RefreshToken: refreshToken,
+		TokenExpiry:  sc.OAuth2Token.Expiry,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(time.Duration(a.sessionCookieMaker.MaxAge) * time.Second),
+	}
+	if err := datastore.InsertSession(a.db, &session); err != nil {
+		return errors.Wrap(err, "failed to store session")
+	}
+
+	sealed, err := a.sessionSealer.Seal(a.sessionCookieMaker.Name, []byte(session.ID))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, a.sessionCookieMaker.NewCookie(sealed))
 	return nil
 }
 
-// get the session state from the session cookie
-func (a *authRouter) getSessionState(r *http.Request) (sessionState, error) {
+// clear the session state by revoking the server side session (if any) and expiring the session cookie
+func (a *authRouter) clearSessionState(w http.ResponseWriter, r *http.Request) error {
+	cookie := a.sessionCookieMaker.NewCookie("")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+
+	sessionID, err := a.getSessionID(r)
+	if err != nil {
+		return nil // nothing to revoke
+	}
+	if state, err := a.getSessionState(r); err == nil {
+		a.verifyCache.Invalidate(state.OAuth2Token.AccessToken)
+	}
+	return datastore.RevokeSession(a.db, sessionID, time.Now())
+}
+
+// get the session ID from the session cookie. A cookie that cannot be decrypted is treated the same as a
+// missing one (i.e. the user is not logged in).
+func (a *authRouter) getSessionID(r *http.Request) (string, error) {
 	sessionCookie, err := r.Cookie(a.sessionCookieMaker.Name)
 	if err != nil {
-		return sessionState{}, err
+		return "", err
 	}
-	dec, err := base64.URLEncoding.DecodeString(sessionCookie.Value)
+	dec, err := a.sessionSealer.Open(a.sessionCookieMaker.Name, sessionCookie.Value)
+	if err != nil {
+		log.Println("Discarding invalid session cookie:", err)
+		return "", errInvalidSession
+	}
+	return string(dec), nil
+}
+
+// get the session state for the session referred to by the session cookie. Sessions that are unknown,
+// expired or revoked are treated as invalid.
+func (a *authRouter) getSessionState(r *http.Request) (sessionState, error) {
+	sessionID, err := a.getSessionID(r)
 	if err != nil {
 		return sessionState{}, err
 	}
-	sc := sessionState{}
-	if err := json.Unmarshal([]byte(dec), &sc); err != nil {
-		return sc, err
+	session, err := datastore.FindActiveSession(a.db, sessionID, time.Now())
+	if err == gorm.ErrRecordNotFound {
+		return sessionState{}, errInvalidSession
+	} else if err != nil {
+		return sessionState{}, errors.Wrap(err, "failed to lookup session")
 	}
-	return sc, nil
+	// sessions whose tokens don't open (e.g. stored before they were sealed) have to login again
+	accessToken, err := a.sessionSealer.OpenToken(sessionAccessTokenSealName, session.AccessToken)
+	if err != nil {
+		return sessionState{}, errInvalidSession
+	}
+	refreshToken, err := a.sessionSealer.OpenToken(sessionRefreshTokenSealName, session.RefreshToken)
+	if err != nil {
+		return sessionState{}, errInvalidSession
+	}
+	mems := []Membership{}
+	if session.Memberships != "" {
+		if err := json.Unmarshal([]byte(session.Memberships), &mems); err != nil {
+			return sessionState{}, errors.Wrap(err, "failed to decode session memberships")
+		}
+	}
+	return sessionState{
+		SessionID: session.ID,
+		UserID:    session.UserID,
+		OAuth2Token: oauth2.Token{
+			AccessToken:  accessToken,
+			TokenType:    session.TokenType,
+			RefreshToken: refreshToken,
+			Expiry:       session.TokenExpiry,
+		},
+		Memberships: mems,
+		Scopes:      splitScopes(session.Scopes),
+		ExpiresAt:   session.ExpiresAt,
+	}, nil
 }
 
-// AuthTokenFromRequest returns the oauth2 token from the request (session cookie)
+// getRequestState returns the state for the request, which is authenticated either by a frontman API token
+// (in the Authorization header) or by the session cookie.
+func (a *authRouter) getRequestState(r *http.Request) (sessionState, error) {
+	if state, ok, err := a.getAPITokenState(r); ok {
+		return state, err
+	}
+	return a.getSessionState(r)
+}
+
+// AuthTokenFromRequest returns the oauth2 token from the request (API token or session cookie)
 func (a *authRouter) AuthTokenFromRequest(r *http.Request) (*oauth2.Token, error) {
-	state, err := a.getSessionState(r)
+	state, err := a.getRequestState(r)
 	if err != nil {
 		return nil, err
 	}
 	return &state.OAuth2Token, nil
 }
 
-// VerifyAuthToken verifies the given OAuth2 token.
-func (a *authRouter) VerifyAuthToken(tok oauth2.Token) (*github.Authorization, error) {
-	// Use the app creds to verify that the token is valid and has the needed scopes
-	client := github.NewClient(&http.Client{
-		Transport: &github.BasicAuthTransport{
-			Username: a.githubConfig.ClientID,
-			Password: a.githubConfig.Secret,
-		},
+// Authenticate resolves the caller of the request (from the API token or session cookie) along with the
+// datastore user they correspond to. Sessions whose token lacks (newly) required scopes are rejected with
+// errMissingScopes, so that the user can be sent through re-consent.
+func (a *authRouter) Authenticate(r *http.Request) (*RequestIdentity, error) {
+	state, err := a.getRequestState(r)
+	if err != nil {
+		return nil, err
+	}
+	if state.SessionID != "" {
+		if err := a.provider.CheckScopes(state.Scopes); err != nil {
+			log.Println("Session", state.SessionID, "needs re-consent:", err)
+			return nil, errMissingScopes
+		}
+	}
+	user, err := datastore.FindUserByID(a.db, state.UserID)
+	if err == gorm.ErrRecordNotFound {
+		return nil, errInvalidSession
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to lookup user")
+	}
+	if user.OffboardedAt != nil {
+		return nil, errOffboarded
+	}
+	return &RequestIdentity{
+		User:        user,
+		Memberships: state.Memberships,
+		Token:       &state.OAuth2Token,
+		ExpiresAt:   state.ExpiresAt,
+	}, nil
+}
+
+// VerifyAuthToken verifies the given OAuth2 (or personal access) token with the identity provider, returning
+// the identity of its owner if they are allowed in. Results are cached.
+func (a *authRouter) VerifyAuthToken(tok oauth2.Token) (*Identity, error) {
+	val, err := a.verifyCache.Verify(tok.AccessToken, func() (interface{}, error) {
+		ctx := context.Background()
+		ident, err := a.provider.Identity(ctx, &tok)
+		if err != nil {
+			return nil, err
+		}
+		mems, err := a.provider.CheckMembership(ctx, &tok, ident)
+		if err != nil {
+			return nil, err
+		}
+		ident.Memberships = mems
+		return ident, nil
 	})
-	auth, _, err := client.Authorizations.Check(a.githubConfig.ClientID, tok.AccessToken)
 	if err != nil {
 		return nil, err
 	}
-	scopeSet := map[github.Scope]bool{}
-	for _, scope := range auth.Scopes {
-		scopeSet[scope] = true
+	return val.(*Identity), nil
+}
+
+// LoginURL returns the (absolute) URL that (re)starts the login flow, returning to the given path afterwards
+func (a *authRouter) LoginURL(returnTo string) string {
+	path := "/auth/" + a.provider.Name() + RouteLogin
+	if isSafeReturnTo(returnTo) {
+		path += "?" + url.Values{"return_to": {returnTo}}.Encode()
 	}
-	for _, scope := range DefaultScopes {
-		if _, there := scopeSet[scope]; !there {
-			return nil, errors.Errorf("auth token is missing scope: %s", scope)
+	return resolveURL(a.baseURL, path)
+}
+
+// splitScopes splits the comma separated list of scopes
+func splitScopes(val string) []string {
+	scopes := []string{}
+	for _, scope := range strings.Split(val, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
 		}
 	}
+	return scopes
+}
 
-	// Now use a new client (using users the token) to check membership to the org
-	tc := oauth2.NewClient(oauth2.NoContext, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok.AccessToken}))
-	client = github.NewClient(tc)
-	mem, _, err := client.Organizations.GetOrgMembership("", a.githubConfig.OrgName)
+// parseBaseURL parses and validates the externally visible base URL of frontman
+func parseBaseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "invalid base URL")
 	}
-	log.Println("mem:", mem)
-	if *mem.State != "active" {
-		return nil, errors.New("not an active member of organization")
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("base URL must be an absolute http(s) URL: %s", raw)
 	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
 
-	return auth, nil
+// resolveURL returns the absolute URL for the given (frontman relative) path, which may include a query
+func resolveURL(baseURL *url.URL, path string) string {
+	u := *baseURL
+	if ref, err := url.Parse(path); err == nil {
+		u.Path = baseURL.Path + ref.Path
+		u.RawQuery = ref.RawQuery
+		u.Fragment = ref.Fragment
+	}
+	return u.String()
+}
+
+// isSafeReturnTo returns true if the given return_to value is a relative path (on our own origin), which
+// makes it safe to redirect to without creating an open redirect.
+func isSafeReturnTo(returnTo string) bool {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		return false // relative paths only, no protocol relative URLs
+	}
+	if strings.ContainsAny(returnTo, "\\\r\n\t") {
+		return false // browsers treat backslashes like slashes
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(u.Path, "//") || strings.ContainsAny(u.Path, "\\\r\n\t") {
+		return false // nor (percent) encoded ones, in case anything decodes the path before redirecting
+	}
+	return u.Scheme == "" && u.Host == "" && u.User == nil && u.Opaque == ""
+}
+
+// personalAccessTokenFromRequest returns the personal access token from the Authorization header or the
+// "access_token" form value of the request.
+func personalAccessTokenFromRequest(r *http.Request) string {
+	if hdr := r.Header.Get("Authorization"); hdr != "" {
+		for _, prefix := range []string{"token ", "Bearer "} {
+			if strings.HasPrefix(hdr, prefix) {
+				return strings.TrimSpace(strings.TrimPrefix(hdr, prefix))
+			}
+		}
+	}
+	return r.FormValue("access_token")
 }
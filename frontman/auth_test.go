@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestIsSafeReturnTo(t *testing.T) {
+	tests := []struct {
+		returnTo string
+		safe     bool
+	}{
+		{"/", true},
+		{"/repositories", true},
+		{"/repositories?page=2#top", true},
+		{"/repositories?next=//evil.com", true},
+		{"/@evil.com", true},
+		{"", false},
+		{"repositories", false},
+		{"evil.com", false},
+		{"//evil.com", false},
+		{"///evil.com", false},
+		{"/\\evil.com", false},
+		{"\\\\evil.com", false},
+		{"/\t/evil.com", false},
+		{"https://evil.com", false},
+		{"HTTPS://evil.com/", false},
+		{"javascript:alert(1)", false},
+		{"//user:pass@evil.com", false},
+		{"https://frontman@evil.com", false},
+		{"/%2Fevil.com", false},
+		{"/%2F%2Fevil.com", false},
+		{"/%5Cevil.com", false},
+		{"/%5C%5Cevil.com", false},
+		{"/%09/evil.com", false},
+		{"/%zz", false},
+	}
+	for _, tc := range tests {
+		if got := isSafeReturnTo(tc.returnTo); got != tc.safe {
+			t.Errorf("%q: expected safe to be %v, got %v", tc.returnTo, tc.safe, got)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+)
+
+// maxVerificationCacheEntries is the number of results the cache holds, beyond it the least recently used
+// results are evicted
+const maxVerificationCacheEntries = 10000
+
+// verificationCache caches the results (successful and otherwise) of verifying tokens with the provider, so that
+// we do not make API calls on every request. Entries are keyed by the SHA-256 of the token, so the cache never
+// holds tokens in the clear.
+type verificationCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	entries     map[[sha256.Size]byte]*list.Element
+	lru         *list.List // of *verificationEntry, the most recently used first
+}
+
+// verificationEntry is a cached verification result
+type verificationEntry struct {
+	key     [sha256.Size]byte
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// newVerificationCache returns a verificationCache that keeps successful results for ttl and failures for
+// negativeTTL. A zero ttl disables caching of successful results (and likewise for negativeTTL).
+func newVerificationCache(ttl, negativeTTL time.Duration) *verificationCache {
+	return &verificationCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxVerificationCacheEntries,
+		entries:     map[[sha256.Size]byte]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+// Verify returns the cached result for the token, calling verify to produce it if there is none.
+func (c *verificationCache) Verify(token string, verify func() (interface{}, error)) (interface{}, error) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	if elem, found := c.entries[key]; found {
+		entry := elem.Value.(*verificationEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry.value, entry.err
+		}
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+
+	value, err := verify()
+
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+		if !isDefinitiveVerificationError(err) {
+			ttl = 0 // don't remember transient (network, upstream, rate limit) failures
+		}
+	}
+	if ttl > 0 {
+		c.mu.Lock()
+		if elem, found := c.entries[key]; found {
+			c.remove(elem) // verified concurrently
+		}
+		entry := &verificationEntry{key: key, value: value, err: err, expires: time.Now().Add(ttl)}
+		c.entries[key] = c.lru.PushFront(entry)
+		for c.lru.Len() > c.maxEntries {
+			c.remove(c.lru.Back())
+		}
+		c.mu.Unlock()
+	}
+	return value, err
+}
+
+// Invalidate removes the cached result for the token
+func (c *verificationCache) Invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[sha256.Sum256([]byte(token))]; found {
+		c.remove(elem)
+	}
+}
+
+// remove removes the entry from the cache (the caller must hold the lock)
+func (c *verificationCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*verificationEntry).key)
+}
+
+// isDefinitiveVerificationError returns true for errors that mean the token (or its owner) was rejected, which
+// can be cached. Everything else (network errors, errors from the providers side, rate limits) is likely to go
+// away on retry and is not cached.
+func isDefinitiveVerificationError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *github.ErrorResponse:
+		return e.Response != nil && isDeniedStatus(e.Response.StatusCode) && !isGithubRateLimited(e.Response)
+	case *statusError:
+		return isDeniedStatus(e.StatusCode)
+	}
+	return errors.Cause(err) == errNotAMember
+}
+
+// isDeniedStatus returns true for the response codes that reject the credentials
+func isDeniedStatus(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
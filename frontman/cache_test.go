@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+)
+
+// countingVerifier returns a verify func that counts its calls and returns err (or the token if err is nil)
+func countingVerifier(calls *int, token string, err error) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		*calls++
+		if err != nil {
+			return nil, err
+		}
+		return token, nil
+	}
+}
+
+func TestVerificationCacheTTL(t *testing.T) {
+	c := newVerificationCache(20*time.Millisecond, 0)
+	calls := 0
+	for i := 0; i < 2; i++ {
+		if val, err := c.Verify("tok", countingVerifier(&calls, "tok", nil)); err != nil || val != "tok" {
+			t.Fatalf("unexpected result: %v %v", val, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected the result to be cached, got %d calls", calls)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	c.Verify("tok", countingVerifier(&calls, "tok", nil))
+	if calls != 2 {
+		t.Errorf("expected the result to expire, got %d calls", calls)
+	}
+
+	c.Invalidate("tok")
+	c.Verify("tok", countingVerifier(&calls, "tok", nil))
+	if calls != 3 {
+		t.Errorf("expected the result to be invalidated, got %d calls", calls)
+	}
+}
+
+func TestVerificationCacheNegative(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		cached bool
+	}{
+		{"not a member", errNotAMember, true},
+		{"transient", errors.New("connection reset"), false},
+	}
+	for _, tc := range tests {
+		c := newVerificationCache(time.Minute, time.Minute)
+		calls := 0
+		for i := 0; i < 2; i++ {
+			if _, err := c.Verify("tok", countingVerifier(&calls, "tok", tc.err)); err != tc.err {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+			}
+		}
+		if cached := calls == 1; cached != tc.cached {
+			t.Errorf("%s: expected cached to be %v, got %d calls", tc.name, tc.cached, calls)
+		}
+	}
+
+	// without a negative TTL failures are never cached
+	c := newVerificationCache(time.Minute, 0)
+	calls := 0
+	c.Verify("tok", countingVerifier(&calls, "tok", errNotAMember))
+	c.Verify("tok", countingVerifier(&calls, "tok", errNotAMember))
+	if calls != 2 {
+		t.Errorf("expected failures not to be cached, got %d calls", calls)
+	}
+}
+
+func TestVerificationCacheEviction(t *testing.T) {
+	c := newVerificationCache(time.Minute, time.Minute)
+	c.maxEntries = 2
+	calls := 0
+	c.Verify("a", countingVerifier(&calls, "a", nil))
+	c.Verify("b", countingVerifier(&calls, "b", nil))
+	c.Verify("a", countingVerifier(&calls, "a", nil)) // a is now the most recently used
+	c.Verify("c", countingVerifier(&calls, "c", errNotAMember))
+	if calls != 3 || len(c.entries) != 2 || c.lru.Len() != 2 {
+		t.Fatalf("expected 3 calls and 2 entries, got %d calls and %d entries", calls, len(c.entries))
+	}
+
+	c.Verify("a", countingVerifier(&calls, "a", nil))
+	if calls != 3 {
+		t.Errorf("expected a to be kept, got %d calls", calls)
+	}
+	c.Verify("b", countingVerifier(&calls, "b", nil))
+	if calls != 4 {
+		t.Errorf("expected b to be evicted, got %d calls", calls)
+	}
+}
+
+func TestIsDefinitiveVerificationError(t *testing.T) {
+	githubError := func(code int, header http.Header) error {
+		if header == nil {
+			header = http.Header{}
+		}
+		return &github.ErrorResponse{Response: &http.Response{StatusCode: code, Header: header}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not a member", errNotAMember, true},
+		{"not a member of group", errors.Wrapf(errNotAMember, "group %s", "devs"), true},
+		{"github unauthorized", githubError(http.StatusUnauthorized, nil), true},
+		{"github forbidden", githubError(http.StatusForbidden, nil), true},
+		{"github rate limit", &github.RateLimitError{Response: &http.Response{StatusCode: http.StatusForbidden}}, false},
+		{"github secondary rate limit", githubError(http.StatusForbidden, http.Header{"Retry-After": {"60"}}), false},
+		{"github rate limit remaining", githubError(http.StatusForbidden, http.Header{"X-Ratelimit-Remaining": {"0"}}), false},
+		{"github not found", githubError(http.StatusNotFound, nil), false},
+		{"github unavailable", githubError(http.StatusServiceUnavailable, nil), false},
+		{"provider unauthorized", errors.Wrap(&statusError{StatusCode: http.StatusUnauthorized}, "failed"), true},
+		{"provider error", &statusError{StatusCode: http.StatusBadGateway}, false},
+		{"network", &url.Error{Op: "Get", URL: "https://api.github.com", Err: errors.New("timeout")}, false},
+		{"other", errors.New("unexpected end of JSON input"), false},
+	}
+	for _, tc := range tests {
+		if got := isDefinitiveVerificationError(tc.err); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
 	"net/http"
+	"net/url"
 
-	"github.com/dghubble/gologin"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -12,7 +19,7 @@ var (
 		Path:     "/",
 		MaxAge:   3600, // FIXME
 		HTTPOnly: true,
-		Secure:   false, // FIXME
+		SameSite: http.SameSiteLaxMode,
 	}
 
 	stateCookieMaker = CookieMaker{
@@ -20,12 +27,42 @@ var (
 		Path:     "/",
 		MaxAge:   60,
 		HTTPOnly: true,
-		Secure:   false, // FIXME
+		SameSite: http.SameSiteLaxMode, // the oauth2 callback is a cross site (top level) navigation
+	}
+
+	// csrfCookieMaker makes the (double submit) CSRF token cookie, which the UI must be able to read
+	csrfCookieMaker = CookieMaker{
+		Name:     "csrf-token",
+		Path:     "/",
+		MaxAge:   3600,
+		SameSite: http.SameSiteStrictMode,
 	}
 )
 
 // CookieMaker creates new cookies
-type CookieMaker gologin.CookieConfig
+type CookieMaker struct {
+	Name     string
+	Domain   string
+	Path     string
+	MaxAge   int
+	HTTPOnly bool
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// ForBaseURL returns a copy of the CookieMaker whose domain, path and secure settings are derived from the
+// externally visible base URL (the domain is left unset for localhost and IP addresses).
+func (cm CookieMaker) ForBaseURL(baseURL *url.URL) CookieMaker {
+	host := baseURL.Hostname()
+	if host != "localhost" && net.ParseIP(host) == nil {
+		cm.Domain = host
+	}
+	if baseURL.Path != "" {
+		cm.Path = baseURL.Path
+	}
+	cm.Secure = baseURL.Scheme == "https"
+	return cm
+}
 
 // NewCookie returns a new http.Cookie with the given value and CookieConfig
 // properties (name, max-age, etc.).
@@ -41,6 +78,7 @@ func (cm *CookieMaker) NewCookie(value string) *http.Cookie {
 		MaxAge:   cm.MaxAge,
 		HttpOnly: cm.HTTPOnly,
 		Secure:   cm.Secure,
+		SameSite: cm.SameSite,
 	}
 	// IE <9 does not understand MaxAge, set Expires if MaxAge is non-zero.
 	// if expires, ok := expiresTime(config.MaxAge); ok {
@@ -48,3 +86,84 @@ func (cm *CookieMaker) NewCookie(value string) *http.Cookie {
 	// }
 	return cookie
 }
+
+// cookieSealer encrypts and authenticates cookie values (AES-GCM) so that the client can neither read nor
+// modify what we store in them. It holds a list of keys to allow rotation: the first key is used to seal new
+// values, all of them are tried when opening values.
+type cookieSealer struct {
+	aeads []cipher.AEAD
+}
+
+// newCookieSealer returns a cookieSealer for the given secrets (the first one being the current one).
+// Secrets of any length are accepted, the actual AES-256 keys are derived from them using SHA-256.
+func newCookieSealer(secrets [][]byte) (*cookieSealer, error) {
+	if len(secrets) <= 0 {
+		return nil, errors.New("no cookie secrets specified")
+	}
+	s := cookieSealer{}
+	for i, secret := range secrets {
+		if len(secret) <= 0 {
+			return nil, errors.Errorf("empty cookie secret (#%d)", i)
+		}
+		key := sha256.Sum256(secret)
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		s.aeads = append(s.aeads, aead)
+	}
+	return &s, nil
+}
+
+// Seal encrypts the plaintext (using the current key) and returns a value suitable for storing in the named
+// cookie. The cookie name is bound to the sealed value, so it cannot be replayed in a different cookie.
+func (s *cookieSealer) Seal(name string, plaintext []byte) (string, error) {
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate nonce")
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts and verifies a value previously returned by Seal for the named cookie, trying each of the
+// keys in turn.
+func (s *cookieSealer) Open(name string, value string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed cookie value")
+	}
+	for _, aead := range s.aeads {
+		if len(sealed) < aead.NonceSize() {
+			return nil, errors.New("cookie value too short")
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(name)); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, errors.New("cookie value failed authentication")
+}
+
+// SealToken seals the (upstream) token for storing at rest under the given name, like Seal. Empty tokens
+// (e.g. missing refresh tokens) are stored as they are.
+func (s *cookieSealer) SealToken(name, token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	return s.Seal(name, []byte(token))
+}
+
+// OpenToken opens a token sealed by SealToken
+func (s *cookieSealer) OpenToken(name, sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	token, err := s.Open(name, sealed)
+	return string(token), err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestCookieSealer(t *testing.T) {
+	old, err := newCookieSealer([][]byte{[]byte("old-secret")})
+	if err != nil {
+		t.Fatalf("failed to create sealer: %v", err)
+	}
+	rotated, err := newCookieSealer([][]byte{[]byte("new-secret"), []byte("old-secret")})
+	if err != nil {
+		t.Fatalf("failed to create sealer: %v", err)
+	}
+	plaintext := []byte("user 42")
+
+	// round trip
+	sealed, err := rotated.Seal("session", plaintext)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if opened, err := rotated.Open("session", sealed); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("expected %q, got %q (%v)", plaintext, opened, err)
+	}
+	if _, err := rotated.Open("state", sealed); err == nil {
+		t.Errorf("expected value sealed for another cookie to be rejected")
+	}
+	if _, err := old.Open("session", sealed); err == nil {
+		t.Errorf("expected value sealed with the new key to be rejected by the old sealer")
+	}
+
+	// values sealed before the rotation still open
+	sealed, err = old.Seal("session", plaintext)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if opened, err := rotated.Open("session", sealed); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("expected old key to open %q, got %q (%v)", plaintext, opened, err)
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(sealed)
+	tampered := append([]byte{}, raw...)
+	tampered[len(tampered)-1] ^= 1
+	tests := map[string]string{
+		"tampered":  base64.RawURLEncoding.EncodeToString(tampered),
+		"truncated": base64.RawURLEncoding.EncodeToString(raw[:len(raw)-4]),
+		"too short": base64.RawURLEncoding.EncodeToString(raw[:4]),
+		"empty":     "",
+		"malformed": "not base64!",
+	}
+	for name, value := range tests {
+		if _, err := rotated.Open("session", value); err == nil {
+			t.Errorf("%s: expected cookie value to be rejected", name)
+		}
+	}
+}
+
+func TestNewCookieSealer(t *testing.T) {
+	if _, err := newCookieSealer(nil); err == nil {
+		t.Errorf("expected sealer without secrets to be refused")
+	}
+	if _, err := newCookieSealer([][]byte{[]byte("secret"), {}}); err == nil {
+		t.Errorf("expected empty secret to be refused")
+	}
+}
+
+func TestCookieSealerTokens(t *testing.T) {
+	s, err := newCookieSealer([][]byte{[]byte("secret")})
+	if err != nil {
+		t.Fatalf("failed to create sealer: %v", err)
+	}
+	if sealed, err := s.SealToken("session-refresh-token", ""); err != nil || sealed != "" {
+		t.Errorf("expected empty token to stay empty, got %q (%v)", sealed, err)
+	}
+	sealed, err := s.SealToken("session-access-token", "gho_secret")
+	if err != nil || sealed == "gho_secret" || bytes.Contains([]byte(sealed), []byte("gho_secret")) {
+		t.Fatalf("expected token to be sealed, got %q (%v)", sealed, err)
+	}
+	if token, err := s.OpenToken("session-access-token", sealed); err != nil || token != "gho_secret" {
+		t.Errorf("expected token to open, got %q (%v)", token, err)
+	}
+	if _, err := s.OpenToken("import-job", sealed); err == nil {
+		t.Errorf("expected token sealed for sessions not to open for import jobs")
+	}
+	if _, err := s.OpenToken("session-access-token", "gho_plaintext"); err == nil {
+		t.Errorf("expected plaintext token to be rejected")
+	}
+}
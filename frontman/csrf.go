@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// CSRFHeader is the header in which browser clients echo the value of the CSRF cookie (double submit)
+	CSRFHeader = "X-CSRF-Token"
+	// csrfExemptPrefix is the prefix of the (webhook) routes that are authenticated by their own secrets or
+	// signatures, and never by cookies
+	csrfExemptPrefix = "/hooks/"
+)
+
+// csrfProtector rejects cross site state changing (non GET) requests. A request is allowed if it carries an
+// Authorization header (API tokens, personal access tokens; browsers never attach these cross site), if its
+// Origin (or Referer) is our own, or if it echoes the CSRF cookie in the CSRF header.
+type csrfProtector struct {
+	baseURL     *url.URL
+	cookieMaker CookieMaker
+}
+
+// newCSRFProtector returns a csrfProtector for frontman running at the given (externally visible) base URL
+func newCSRFProtector(baseURL *url.URL) *csrfProtector {
+	return &csrfProtector{
+		baseURL:     baseURL,
+		cookieMaker: csrfCookieMaker.ForBaseURL(baseURL),
+	}
+}
+
+// Middleware returns the CSRF protecting middleware (for use with goji.Mux.Use)
+func (c *csrfProtector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			c.ensureCookie(w, r)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := c.check(r); err != "" {
+			log.Printf("[CSRF] Rejecting %s %s: %s", r.Method, r.URL.Path, err)
+			handleForbidden(w, "CSRF check failed: "+err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check returns a description of why the request failed the CSRF check, or "" if it passed
+func (c *csrfProtector) check(r *http.Request) string {
+	if r.Header.Get("Authorization") != "" || strings.HasPrefix(r.URL.Path, csrfExemptPrefix) {
+		return ""
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		if !c.isSameOrigin(origin) {
+			return "cross origin request"
+		}
+		return ""
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		if !c.isSameOrigin(referer) {
+			return "cross origin referer"
+		}
+		return ""
+	}
+	cookie, err := r.Cookie(c.cookieMaker.Name)
+	if err != nil || cookie.Value == "" {
+		return "missing CSRF cookie"
+	}
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.Header.Get(CSRFHeader))) != 1 {
+		return "CSRF token mismatch"
+	}
+	return ""
+}
+
+// isSameOrigin returns true if the given URL has the same scheme and host as our base URL
+func (c *csrfProtector) isSameOrigin(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, c.baseURL.Scheme) && strings.EqualFold(u.Host, c.baseURL.Host)
+}
+
+// ensureCookie issues a CSRF cookie if the request does not already carry one
+func (c *csrfProtector) ensureCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(c.cookieMaker.Name); err == nil && cookie.Value != "" {
+		return
+	}
+	rnd := make([]byte, 32)
+	if _, err := rand.Read(rnd); err != nil {
+		log.Println("[CSRF] Failed to generate CSRF token:", err)
+		return
+	}
+	http.SetCookie(w, c.cookieMaker.NewCookie(base64.RawURLEncoding.EncodeToString(rnd)))
+}
+
+// isSafeMethod returns true for HTTP methods that must not change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
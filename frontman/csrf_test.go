@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCSRFProtector(t *testing.T) {
+	baseURL, _ := url.Parse("https://frontman.example.com")
+	handler := newCSRFProtector(baseURL).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		cookie  string
+		want    int
+	}{
+		{"safe method", "GET", nil, "", http.StatusOK},
+		{"same origin", "PUT", map[string]string{"Origin": "https://frontman.example.com"}, "", http.StatusOK},
+		{"cross origin", "POST", map[string]string{"Origin": "https://evil.example.com"}, "", http.StatusForbidden},
+		{"cross referer", "POST", map[string]string{"Referer": "https://evil.example.com/x"}, "", http.StatusForbidden},
+		{"api token", "PUT", map[string]string{"Authorization": "Bearer polly_abc"}, "", http.StatusOK},
+		{"no origin or token", "POST", nil, "", http.StatusForbidden},
+		{"double submit", "POST", map[string]string{CSRFHeader: "abc"}, "abc", http.StatusOK},
+		{"double submit mismatch", "POST", map[string]string{CSRFHeader: "abd"}, "abc", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/auth/logout", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookieMaker.Name, Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Models
+
+// APIToken is a (long lived) token issued by frontman to a user, for use by automation. Only the hash of the
+// token is stored, the upstream token it acts with is stored sealed (encrypted) by frontman.
+type APIToken struct {
+	ID          uint       `json:"id" gorm:"primary_key"`
+	UserID      uint       `json:"-" gorm:"index"`
+	Name        string     `json:"name"`
+	Hash        string     `json:"-" gorm:"unique_index"`
+	Scopes      string     `json:"scopes"` // comma separated
+	AccessToken string     `json:"-"`      // sealed upstream (identity provider) token the API token acts with
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+// InsertAPIToken inserts the token into the database
+func InsertAPIToken(db *gorm.DB, token *APIToken) error {
+	return db.Create(token).Error
+}
+
+// FindActiveAPIToken returns the token with the specified hash, provided it has neither expired nor been
+// revoked (as of now)
+func FindActiveAPIToken(db *gorm.DB, hash string, now time.Time) (*APIToken, error) {
+	var token APIToken
+	err := db.Where("hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", hash, now).
+		First(&token).Error
+	return &token, err
+}
+
+// ListAPITokensForUser returns all the tokens (including revoked ones) issued to the user
+func ListAPITokensForUser(db *gorm.DB, userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := db.Where("user_id = ?", userID).Order("id").Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeAPIToken marks the users token with the specified ID as revoked. It returns gorm.ErrRecordNotFound if
+// the user has no such (unrevoked) token.
+func RevokeAPIToken(db *gorm.DB, userID, id uint, now time.Time) error {
+	res := db.Model(&APIToken{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteAPITokensForUser removes all the tokens issued to the user
+func DeleteAPITokensForUser(db *gorm.DB, userID uint) error {
+	return db.Where("user_id = ?", userID).Delete(&APIToken{}).Error
+}
+
+// TouchAPIToken records that the token with the specified ID was used (now)
+func TouchAPIToken(db *gorm.DB, id uint, now time.Time) error {
+	return db.Model(&APIToken{}).Where("id = ?", id).UpdateColumn("last_used_at", now).Error
+}
@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPITokenLifecycle(t *testing.T) {
+	db := newInMemoeryDB()
+	now := time.Now()
+	past := now.Add(-time.Hour)
+
+	live := APIToken{UserID: 7, Name: "ci", Hash: "hash-live"}
+	expired := APIToken{UserID: 7, Name: "old", Hash: "hash-expired", ExpiresAt: &past}
+	for _, tok := range []*APIToken{&live, &expired} {
+		if err := InsertAPIToken(db, tok); err != nil {
+			t.Fatalf("failed to insert token %s: %v", tok.Name, err)
+		}
+	}
+
+	if _, err := FindActiveAPIToken(db, "hash-live", now); err != nil {
+		t.Errorf("failed to find live token: %v", err)
+	}
+	if _, err := FindActiveAPIToken(db, "hash-expired", now); err == nil {
+		t.Errorf("expired token should not be found")
+	}
+
+	if err := RevokeAPIToken(db, 8, live.ID, now); err == nil {
+		t.Errorf("other users should not be able to revoke the token")
+	}
+	if err := RevokeAPIToken(db, 7, live.ID, now); err != nil {
+		t.Errorf("failed to revoke token: %v", err)
+	}
+	if _, err := FindActiveAPIToken(db, "hash-live", now); err == nil {
+		t.Errorf("revoked token should not be found")
+	}
+
+	tokens, err := ListAPITokensForUser(db, 7)
+	if err != nil {
+		t.Errorf("failed to list tokens: %v", err)
+	} else if len(tokens) != 2 {
+		t.Errorf("expected 2 tokens, got %d", len(tokens))
+	}
+}
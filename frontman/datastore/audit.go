@@ -0,0 +1,33 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Models
+
+// AuditEvent records an action polly took (or, in dry runs, would have taken) on someones behalf
+type AuditEvent struct {
+	ID        uint      `json:"id" gorm:"primary_key"`
+	Actor     string    `json:"actor"`                // who (or which job) took the action
+	Action    string    `json:"action"`               // e.g. deactivate-account
+	Subject   string    `json:"subject" gorm:"index"` // who (or what) the action was taken on
+	Detail    string    `json:"detail"`
+	DryRun    bool      `json:"dry_run"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InsertAuditEvent inserts the event into the database
+func InsertAuditEvent(db *gorm.DB, event *AuditEvent) error {
+	return db.Create(event).Error
+}
+
+// ListAuditEvents returns the most recent events (at most limit of them), most recent first
+func ListAuditEvents(db *gorm.DB, limit int) ([]AuditEvent, error) {
+	var events []AuditEvent
+	err := db.Order("id desc").Limit(limit).Find(&events).Error
+	return events, err
+}
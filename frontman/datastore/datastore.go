@@ -7,10 +7,17 @@ func OpenDatabase(dbtype, dsn string) (*gorm.DB, error) {
 	return gorm.Open(dbtype, dsn)
 }
 
-// MigrateDatabase runs migrations on the database
+// MigrateDatabase runs migrations on the database, upgrading tables created by earlier versions first
 func MigrateDatabase(db *gorm.DB) error {
+	if err := migrateLegacyTables(db); err != nil {
+		return err
+	}
 	return db.AutoMigrate(&User{},
 		&Organization{},
 		&Repository{},
-		&Server{}).Error
+		&Server{},
+		&Session{},
+		&APIToken{},
+		&ImportJob{},
+		&AuditEvent{}).Error
 }
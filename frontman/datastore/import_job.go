@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The states an import job goes through
+const (
+	ImportQueued      = "queued"
+	ImportCloning     = "cloning"
+	ImportPushing     = "pushing"
+	ImportConfiguring = "configuring"
+	ImportDone        = "done"
+	ImportFailed      = "failed"
+	ImportCancelled   = "cancelled"
+)
+
+// Models
+
+// ImportJob is a (background) import of a Github repository into a Gerrit project
+type ImportJob struct {
+	ID            uint       `json:"id" gorm:"primary_key"`
+	UserID        uint       `json:"user_id" gorm:"index"`
+	Org           string     `json:"org"`
+	Repo          string     `json:"repo"`
+	Project       string     `json:"project"`
+	CloneURL      string     `json:"clone_url"`
+	DefaultBranch string     `json:"default_branch"`
+	Description   string     `json:"description"`
+	AccessToken   string     `json:"-"` // the importers (sealed) token, cleared once the job finishes
+	State         string     `json:"state" gorm:"index"`
+	Log           string     `json:"log" gorm:"type:text"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	StartedAt     *time.Time `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+}
+
+// Finished returns true if the job is in a final state
+func (j *ImportJob) Finished() bool {
+	return j.State == ImportDone || j.State == ImportFailed || j.State == ImportCancelled
+}
+
+// InsertImportJob inserts the job into the database
+func InsertImportJob(db *gorm.DB, job *ImportJob) error {
+	return db.Create(job).Error
+}
+
+// SaveImportJob updates (all the fields of) the job in the database
+func SaveImportJob(db *gorm.DB, job *ImportJob) error {
+	return db.Save(job).Error
+}
+
+// FindImportJob returns the job with the specified ID
+func FindImportJob(db *gorm.DB, id uint) (*ImportJob, error) {
+	var job ImportJob
+	err := db.First(&job, id).Error
+	return &job, err
+}
+
+// ListImportJobsForUser returns the jobs (most recent first) started by the user
+func ListImportJobsForUser(db *gorm.DB, userID uint) ([]ImportJob, error) {
+	var jobs []ImportJob
+	err := db.Where("user_id = ?", userID).Order("id desc").Find(&jobs).Error
+	return jobs, err
+}
+
+// ClaimNextImportJob moves the oldest queued job into the cloning state and returns it. It returns
+// gorm.ErrRecordNotFound if there are no queued jobs.
+func ClaimNextImportJob(db *gorm.DB, now time.Time) (*ImportJob, error) {
+	for {
+		var job ImportJob
+		if err := db.Where("state = ?", ImportQueued).Order("id").First(&job).Error; err != nil {
+			return nil, err
+		}
+		res := db.Model(&ImportJob{}).Where("id = ? AND state = ?", job.ID, ImportQueued).
+			Updates(map[string]interface{}{"state": ImportCloning, "started_at": now})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			return FindImportJob(db, job.ID)
+		}
+		// someone else claimed it first, try the next one
+	}
+}
+
+// CancelQueuedImportJob moves the job into the cancelled state, provided it is still queued. It returns
+// gorm.ErrRecordNotFound if the job is not queued.
+func CancelQueuedImportJob(db *gorm.DB, id uint, now time.Time) error {
+	res := db.Model(&ImportJob{}).Where("id = ? AND state = ?", id, ImportQueued).
+		Updates(map[string]interface{}{"state": ImportCancelled, "finished_at": now, "access_token": ""})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// RequeueRunningImportJobs moves jobs that were running (e.g. when the server was restarted) back into the
+// queued state, so that they are started afresh
+func RequeueRunningImportJobs(db *gorm.DB) error {
+	return db.Model(&ImportJob{}).Where("state IN (?)", []string{ImportCloning, ImportPushing, ImportConfiguring}).
+		Update("state", ImportQueued).Error
+}
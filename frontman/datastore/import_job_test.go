@@ -0,0 +1,47 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImportJobQueue(t *testing.T) {
+	db := newInMemoeryDB()
+	now := time.Now()
+
+	first := ImportJob{UserID: 1, Org: "acme", Repo: "one", State: ImportQueued}
+	second := ImportJob{UserID: 1, Org: "acme", Repo: "two", State: ImportQueued}
+	for _, job := range []*ImportJob{&first, &second} {
+		if err := InsertImportJob(db, job); err != nil {
+			t.Fatalf("failed to insert job %s: %v", job.Repo, err)
+		}
+	}
+
+	claimed, err := ClaimNextImportJob(db, now)
+	if err != nil {
+		t.Fatalf("failed to claim job: %v", err)
+	}
+	if claimed.ID != first.ID || claimed.State != ImportCloning || claimed.StartedAt == nil {
+		t.Errorf("expected the oldest job to be claimed (and started), got %+v", claimed)
+	}
+	if err := CancelQueuedImportJob(db, first.ID, now); err == nil {
+		t.Errorf("running jobs should not be cancelled as queued ones")
+	}
+	if err := CancelQueuedImportJob(db, second.ID, now); err != nil {
+		t.Errorf("failed to cancel queued job: %v", err)
+	}
+	if _, err := ClaimNextImportJob(db, now); err == nil {
+		t.Errorf("cancelled jobs should not be claimed")
+	}
+
+	// a restart puts the running job back in the queue
+	if err := RequeueRunningImportJobs(db); err != nil {
+		t.Fatalf("failed to requeue running jobs: %v", err)
+	}
+	if claimed, err := ClaimNextImportJob(db, now); err != nil || claimed.ID != first.ID {
+		t.Errorf("expected requeued job to be claimed, got %+v (%v)", claimed, err)
+	}
+	if job, _ := FindImportJob(db, second.ID); !job.Finished() {
+		t.Errorf("expected cancelled job to be finished, got state %s", job.State)
+	}
+}
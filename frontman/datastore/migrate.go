@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Earlier versions of polly keyed some tables by name, rather than by (auto incremented) ID. AutoMigrate can't
+// change the primary key of an existing table, so those tables are rebuilt (and their rows copied, getting
+// fresh IDs) before it runs.
+
+// legacyUser is a row of the users table as created by earlier versions
+type legacyUser struct {
+	Username string
+	GithubID int
+}
+
+// legacyRepository is a row of the repositories table as created by earlier versions
+type legacyRepository struct {
+	Name           string
+	GithubID       int
+	OrganizationID string
+}
+
+// migrateLegacyTables rebuilds the tables (if any) that still have their legacy schema
+func migrateLegacyTables(db *gorm.DB) error {
+	if isLegacyTable(db, "users") {
+		if err := rebuildTable(db, "users", &User{}, migrateLegacyUsers); err != nil {
+			return errors.Wrap(err, "failed to migrate users")
+		}
+	}
+	if isLegacyTable(db, "repositories") {
+		if err := rebuildTable(db, "repositories", &Repository{}, migrateLegacyRepositories); err != nil {
+			return errors.Wrap(err, "failed to migrate repositories")
+		}
+	}
+	return nil
+}
+
+// migrateLegacyUsers copies the users from the legacy table (their passwords are dropped, they were never
+// used)
+func migrateLegacyUsers(tx *gorm.DB, legacy string) error {
+	var users []legacyUser
+	if err := tx.Table(legacy).Select("username, github_id").Order("username").Scan(&users).Error; err != nil {
+		return err
+	}
+	for _, old := range users {
+		if err := tx.Create(&User{Username: old.Username, GithubID: old.GithubID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLegacyRepositories copies the repositories from the legacy table. They were imported into gerrit
+// projects named after the repository, but without their clone URL, so they are marked RepositoryLegacy.
+// Repositories are unique per org now, only the first of any duplicates is kept.
+func migrateLegacyRepositories(tx *gorm.DB, legacy string) error {
+	var repos []legacyRepository
+	err := tx.Table(legacy).Select("name, github_id, organization_id").Order("name").Scan(&repos).Error
+	if err != nil {
+		return err
+	}
+	seen := map[[2]string]bool{}
+	for _, old := range repos {
+		key := [2]string{old.OrganizationID, old.Name}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		repo := Repository{
+			OrganizationID: old.OrganizationID,
+			Name:           old.Name,
+			GithubID:       old.GithubID,
+			GerritProject:  old.Name,
+			Status:         RepositoryLegacy,
+		}
+		if err := tx.Create(&repo).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLegacyTable returns true if the table exists, but has no id column
+func isLegacyTable(db *gorm.DB, table string) bool {
+	if !db.HasTable(table) {
+		return false
+	}
+	rows, err := db.Raw("SELECT id FROM " + table + " WHERE 1 = 0").Rows()
+	if err != nil {
+		return true
+	}
+	rows.Close()
+	return false
+}
+
+// rebuildTable renames the (legacy) table out of the way, creates it afresh for the model and copies the rows
+// over (using copyRows), all in one transaction
+func rebuildTable(db *gorm.DB, table string, model interface{}, copyRows func(tx *gorm.DB, legacy string) error) error {
+	legacy := table + "_legacy"
+	tx := db.Begin()
+	if err := tx.Exec("ALTER TABLE " + table + " RENAME TO " + legacy).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.AutoMigrate(model).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := copyRows(tx, legacy); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to copy rows")
+	}
+	if err := tx.DropTable(legacy).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// newLegacyDB returns an (unmigrated) in-memory database with the tables created by the given statements
+func newLegacyDB(t *testing.T, name string, stmts ...string) *gorm.DB {
+	db, err := OpenDatabase("sqlite3", "file:"+name+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("failed to create in-memory db: %v", err)
+	}
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("failed to setup legacy db (%s): %v", stmt, err)
+		}
+	}
+	return db
+}
+
+func TestMigrateLegacyUsers(t *testing.T) {
+	db := newLegacyDB(t, "legacy-users",
+		`CREATE TABLE users (username varchar(255), password varchar(255), github_id integer, PRIMARY KEY (username))`,
+		`INSERT INTO users (username, password, github_id) VALUES ('mona', 'x', 42), ('hubot', 'y', 7)`,
+	)
+	for i := 0; i < 2; i++ { // migrating is idempotent
+		if err := MigrateDatabase(db); err != nil {
+			t.Fatalf("failed to migrate legacy db: %v", err)
+		}
+	}
+
+	user, err := FindUser(db, 42)
+	if err != nil {
+		t.Fatalf("failed to find migrated user: %v", err)
+	}
+	if user.ID == 0 || user.Username != "mona" {
+		t.Errorf("expected migrated user with an ID, got %+v", user)
+	}
+
+	// logging in again updates the migrated user (and records its provider and subject), rather than adding another
+	login := User{Provider: "github", Subject: "42", Username: "mona", GithubID: 42, Name: "Mona"}
+	if err := UpsertUser(db, &login); err != nil {
+		t.Fatalf("failed to upsert migrated user: %v", err)
+	}
+	if login.ID != user.ID {
+		t.Errorf("expected upsert to update user %d, got %d", user.ID, login.ID)
+	}
+	var count int
+	db.Model(&User{}).Count(&count)
+	if count != 2 {
+		t.Errorf("expected 2 users after migrating, got %d", count)
+	}
+	if db.HasTable("users_legacy") {
+		t.Errorf("legacy table should be dropped")
+	}
+}
+
+func TestMigrateLegacyRepositories(t *testing.T) {
+	db := newLegacyDB(t, "legacy-repositories",
+		`CREATE TABLE repositories (name varchar(255), github_id integer, organization_id varchar(255), PRIMARY KEY (name))`,
+		`INSERT INTO repositories (name, github_id, organization_id) VALUES ('widgets', 1, 'acme'), ('gadgets', 2, 'other')`,
+	)
+	for i := 0; i < 2; i++ { // migrating is idempotent
+		if err := MigrateDatabase(db); err != nil {
+			t.Fatalf("failed to migrate legacy db: %v", err)
+		}
+	}
+
+	repo, err := FindRepositoryByName(db, "acme", "widgets")
+	if err != nil {
+		t.Fatalf("failed to find migrated repository: %v", err)
+	}
+	if repo.ID == 0 || repo.GithubID != 1 || repo.GerritProject != "widgets" || repo.Status != RepositoryLegacy {
+		t.Errorf("unexpected migrated repository: %+v", repo)
+	}
+
+	// the same name can be used in another org now, but not twice in the same one
+	if err := InsertRepository(db, &Repository{OrganizationID: "other", Name: "widgets"}); err != nil {
+		t.Errorf("failed to insert repository with the same name in another org: %v", err)
+	}
+	if err := InsertRepository(db, &Repository{OrganizationID: "acme", Name: "widgets"}); err == nil {
+		t.Errorf("repositories should (still) be unique per org")
+	}
+}
@@ -0,0 +1,29 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Models
+
+// Organization represents a Github organization whose members are allowed to use polly
+type Organization struct {
+	Name      string    `json:"name" gorm:"primary_key"`
+	Role      string    `json:"role"` // role granted to members admitted via this org
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// SaveOrganization inserts the org into the database, or updates it if it exists
+func SaveOrganization(db *gorm.DB, org *Organization) error {
+	return db.Save(org).Error
+}
+
+// ListOrganizations returns all the orgs
+func ListOrganizations(db *gorm.DB) ([]Organization, error) {
+	var orgs []Organization
+	err := db.Order("name").Find(&orgs).Error
+	return orgs, err
+}
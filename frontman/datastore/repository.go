@@ -1,24 +1,146 @@
 package datastore
 
-import "github.com/jinzhu/gorm"
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// The states of an imported repository
+const (
+	RepositoryImporting = "importing"
+	RepositoryImported  = "imported"
+	RepositoryFailed    = "failed"
+	// RepositoryLegacy repositories were imported by earlier versions, which didn't record their clone URL.
+	// They are neither replicated nor mirrored until they are imported again.
+	RepositoryLegacy = "legacy"
+)
+
+// The states of the replication (from gerrit back to Github) of a repository
+const (
+	ReplicationPending = "pending"
+	ReplicationOK      = "ok"
+	ReplicationFailed  = "failed"
+)
+
+// The states of the mirroring (from Github into gerrit, of pushes that still land on Github) of a repository
+const (
+	MirrorOK       = "ok"
+	MirrorDiverged = "diverged" // some refs could not be fast-forwarded, they need to be reconciled by hand
+	MirrorFailed   = "failed"
+)
 
 // Models
 
-// Repository is the representation of a respository in polly
+// Repository is the representation of a respository in polly (a Github repository imported into Gerrit).
+// Repositories are unique per org.
 type Repository struct {
-	Name           string `json:"name" gorm:"primary_key"`
-	GithubID       int    `json:"github_id"`
-	OrganizationID string `json:"-"`
+	ID             uint       `json:"id" gorm:"primary_key"`
+	OrganizationID string     `json:"org" gorm:"unique_index:idx_repository_org_name"`
+	Name           string     `json:"name" gorm:"unique_index:idx_repository_org_name"`
+	GithubID       int        `json:"github_id"`
+	GerritProject  string     `json:"gerrit_project"`
+	ImportedBy     uint       `json:"imported_by"` // user ID
+	ImportJobID    uint       `json:"import_job_id"`
+	Status         string     `json:"status"`
+	ImportedAt     *time.Time `json:"imported_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// GithubCloneURL is where submitted changes (and new branches and tags) are replicated to
+	GithubCloneURL    string     `json:"github_clone_url"`
+	ReplicationStatus string     `json:"replication_status"`
+	ReplicationError  string     `json:"replication_error,omitempty"`
+	ReplicatedAt      *time.Time `json:"replicated_at"`
+
+	MirrorStatus string     `json:"mirror_status"`
+	MirrorError  string     `json:"mirror_error,omitempty"`
+	DivergedRefs string     `json:"diverged_refs,omitempty"` // comma separated
+	MirroredAt   *time.Time `json:"mirrored_at"`
 }
 
-// InsertRepository inserts the user into the database
+// InsertRepository inserts the repository into the database
 func InsertRepository(db *gorm.DB, repo *Repository) error {
-	return db.Debug().Create(repo).Error
+	return db.Create(repo).Error
+}
+
+// SaveRepository updates (all the fields of) the repository in the database
+func SaveRepository(db *gorm.DB, repo *Repository) error {
+	return db.Save(repo).Error
+}
+
+// FindRepositoryByName returns the repository with the specified name in the org
+func FindRepositoryByName(db *gorm.DB, org, name string) (*Repository, error) {
+	var repo Repository
+	err := db.Where("organization_id = ? AND name = ?", org, name).First(&repo).Error
+	return &repo, err
+}
+
+// FindRepositoryByID returns the repository with the specified ID
+func FindRepositoryByID(db *gorm.DB, id uint) (*Repository, error) {
+	var repo Repository
+	err := db.First(&repo, id).Error
+	return &repo, err
+}
+
+// FindRepositoryByGithubID returns the repository imported from the specified Github repository
+func FindRepositoryByGithubID(db *gorm.DB, githubID int) (*Repository, error) {
+	var repo Repository
+	err := db.Where("github_id = ?", githubID).First(&repo).Error
+	return &repo, err
 }
 
-// FindRepositoryByName returns the user with the specified name
-func FindRepositoryByName(db *gorm.DB, name string) (*Repository, error) {
+// FindRepositoryByProject returns the repository imported into the specified gerrit project
+func FindRepositoryByProject(db *gorm.DB, project string) (*Repository, error) {
 	var repo Repository
-	err := db.Where("name = ?", name).First(&repo).Error
+	err := db.Where("gerrit_project = ?", project).First(&repo).Error
 	return &repo, err
 }
+
+// ListRepositoriesForOrganization returns the repositories (imported or being imported) of the org
+func ListRepositoriesForOrganization(db *gorm.DB, org string) ([]Repository, error) {
+	var repos []Repository
+	err := db.Where("organization_id = ?", org).Order("name").Find(&repos).Error
+	return repos, err
+}
+
+// SetRepositoryImportJob records the import job of the repository (leaving its other fields alone)
+func SetRepositoryImportJob(db *gorm.DB, id, importJobID uint) error {
+	return db.Model(&Repository{}).Where("id = ?", id).UpdateColumn("import_job_id", importJobID).Error
+}
+
+// UpdateRepositoryStatus records the status (e.g. the outcome of the import) of the repository in the org
+func UpdateRepositoryStatus(db *gorm.DB, org, name, status string, now time.Time) error {
+	fields := map[string]interface{}{"status": status}
+	if status == RepositoryImported {
+		fields["imported_at"] = now
+	}
+	return db.Model(&Repository{}).Where("organization_id = ? AND name = ?", org, name).Updates(fields).Error
+}
+
+// UpdateRepositoryReplication records the outcome of (an attempt at) replicating the repository
+func UpdateRepositoryReplication(db *gorm.DB, id uint, status, errMsg string, now time.Time) error {
+	fields := map[string]interface{}{"replication_status": status, "replication_error": errMsg}
+	if status == ReplicationOK {
+		fields["replicated_at"] = now
+	}
+	return db.Model(&Repository{}).Where("id = ?", id).Updates(fields).Error
+}
+
+// UpdateRepositoryMirror records the outcome of (an attempt at) mirroring Github pushes into the repository,
+// along with the refs that diverged (if any)
+func UpdateRepositoryMirror(db *gorm.DB, id uint, diverged []string, errMsg string, now time.Time) error {
+	status := MirrorOK
+	if errMsg != "" {
+		status = MirrorFailed
+	} else if len(diverged) > 0 {
+		status = MirrorDiverged
+	}
+	fields := map[string]interface{}{"mirror_status": status, "mirror_error": errMsg}
+	if status != MirrorFailed { // the refs that diverged before the failure are still diverged
+		fields["diverged_refs"] = strings.Join(diverged, ",")
+		fields["mirrored_at"] = now
+	}
+	return db.Model(&Repository{}).Where("id = ?", id).Updates(fields).Error
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepositoryPerOrg(t *testing.T) {
+	db := newInMemoeryDB()
+
+	acme := Repository{OrganizationID: "acme", Name: "widgets", GerritProject: "acme/widgets", ImportJobID: 1, Status: RepositoryImporting}
+	other := Repository{OrganizationID: "other", Name: "widgets", GerritProject: "other/widgets", ImportJobID: 2, Status: RepositoryImporting}
+	for _, repo := range []*Repository{&acme, &other} {
+		if err := InsertRepository(db, repo); err != nil {
+			t.Fatalf("failed to insert repository %s: %v", repo.GerritProject, err)
+		}
+	}
+	dup := Repository{OrganizationID: "acme", Name: "widgets"}
+	if err := InsertRepository(db, &dup); err == nil {
+		t.Errorf("repositories should be unique per org")
+	}
+
+	if err := UpdateRepositoryStatus(db, "acme", "widgets", RepositoryImported, time.Now()); err != nil {
+		t.Fatalf("failed to update repository status: %v", err)
+	}
+	repo, err := FindRepositoryByName(db, "acme", "widgets")
+	if err != nil {
+		t.Fatalf("failed to find repository: %v", err)
+	}
+	if repo.Status != RepositoryImported || repo.ImportedAt == nil {
+		t.Errorf("expected repository to be imported, got %+v", repo)
+	}
+	if repo, _ := FindRepositoryByName(db, "other", "widgets"); repo.Status != RepositoryImporting {
+		t.Errorf("other orgs repository should be unaffected, got status %s", repo.Status)
+	}
+
+	repos, err := ListRepositoriesForOrganization(db, "acme")
+	if err != nil || len(repos) != 1 {
+		t.Errorf("expected 1 repository for acme, got %d (%v)", len(repos), err)
+	}
+}
+
+func TestRepositoryMirror(t *testing.T) {
+	db := newInMemoeryDB()
+
+	repo := Repository{OrganizationID: "acme", Name: "gadgets", GithubID: 7, GerritProject: "acme/gadgets", Status: RepositoryImported}
+	if err := InsertRepository(db, &repo); err != nil {
+		t.Fatalf("failed to insert repository: %v", err)
+	}
+	if found, err := FindRepositoryByGithubID(db, 7); err != nil || found.ID != repo.ID {
+		t.Fatalf("failed to find repository by github ID: %v", err)
+	}
+
+	if err := UpdateRepositoryMirror(db, repo.ID, []string{"refs/heads/main", "refs/tags/v1"}, "", time.Now()); err != nil {
+		t.Fatalf("failed to update mirror status: %v", err)
+	}
+	found, _ := FindRepositoryByID(db, repo.ID)
+	if found.MirrorStatus != MirrorDiverged || found.DivergedRefs != "refs/heads/main,refs/tags/v1" || found.MirroredAt == nil {
+		t.Errorf("expected diverged refs to be recorded, got %+v", found)
+	}
+
+	if err := UpdateRepositoryMirror(db, repo.ID, nil, "network unreachable", time.Now()); err != nil {
+		t.Fatalf("failed to update mirror status: %v", err)
+	}
+	found, _ = FindRepositoryByID(db, repo.ID)
+	if found.MirrorStatus != MirrorFailed || found.DivergedRefs == "" {
+		t.Errorf("failures should be recorded without forgetting the diverged refs, got %+v", found)
+	}
+
+	if err := UpdateRepositoryMirror(db, repo.ID, nil, "", time.Now()); err != nil {
+		t.Fatalf("failed to update mirror status: %v", err)
+	}
+	found, _ = FindRepositoryByID(db, repo.ID)
+	if found.MirrorStatus != MirrorOK || found.DivergedRefs != "" || found.MirrorError != "" {
+		t.Errorf("expected repository to be in sync, got %+v", found)
+	}
+}
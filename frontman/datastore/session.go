@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Models
+
+// Session represents an authenticated (browser) session. The ID is opaque and random, it is the only thing
+// handed to the client.
+type Session struct {
+	ID           string `gorm:"primary_key"`
+	UserID       uint   `gorm:"index"`
+	AccessToken  string // sealed upstream token
+	TokenType    string
+	RefreshToken string // sealed upstream refresh token (if any)
+	TokenExpiry  time.Time
+	Memberships  string // JSON encoded orgs (and roles) that admitted the session
+	Scopes       string // comma separated scopes granted to the token
+	CreatedAt    time.Time
+	ExpiresAt    time.Time `gorm:"index"`
+	RevokedAt    *time.Time
+}
+
+// InsertSession inserts the session into the database
+func InsertSession(db *gorm.DB, session *Session) error {
+	return db.Create(session).Error
+}
+
+// FindActiveSession returns the session with the specified ID, provided it has neither expired nor been
+// revoked (as of now)
+func FindActiveSession(db *gorm.DB, id string, now time.Time) (*Session, error) {
+	var session Session
+	err := db.Where("id = ? AND revoked_at IS NULL AND expires_at > ?", id, now).First(&session).Error
+	return &session, err
+}
+
+// RevokeSession marks the session with the specified ID as revoked, so that it is no longer accepted
+func RevokeSession(db *gorm.DB, id string, now time.Time) error {
+	return db.Model(&Session{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", now).Error
+}
+
+// DeleteSessionsForUser removes all the sessions of the user
+func DeleteSessionsForUser(db *gorm.DB, userID uint) error {
+	return db.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+
+// DeleteExpiredSessions removes sessions that expired before the specified time
+func DeleteExpiredSessions(db *gorm.DB, before time.Time) error {
+	return db.Where("expires_at <= ?", before).Delete(&Session{}).Error
+}
@@ -0,0 +1,35 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindActiveSession(t *testing.T) {
+	db := newInMemoeryDB()
+	now := time.Now()
+
+	live := Session{ID: "live", AccessToken: "tok1", ExpiresAt: now.Add(time.Hour)}
+	expired := Session{ID: "expired", AccessToken: "tok2", ExpiresAt: now.Add(-time.Hour)}
+	for _, s := range []*Session{&live, &expired} {
+		if err := InsertSession(db, s); err != nil {
+			t.Fatalf("failed to insert session %s: %v", s.ID, err)
+		}
+	}
+
+	if s, err := FindActiveSession(db, "live", now); err != nil {
+		t.Errorf("failed to find live session: %v", err)
+	} else if s.AccessToken != "tok1" {
+		t.Errorf("unexpected access token in session: %s", s.AccessToken)
+	}
+	if _, err := FindActiveSession(db, "expired", now); err == nil {
+		t.Errorf("expired session should not be found")
+	}
+
+	if err := RevokeSession(db, "live", now); err != nil {
+		t.Errorf("failed to revoke session: %v", err)
+	}
+	if _, err := FindActiveSession(db, "live", now); err == nil {
+		t.Errorf("revoked session should not be found")
+	}
+}
@@ -1,14 +1,28 @@
 package datastore
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
 
 // Models
 
-// User represents a user
+// User represents a user (who has logged in to polly at least once)
 type User struct {
-	Username string `gorm:"primary_key"`
-	Password string
-	GithubID int
+	ID              uint       `json:"id" gorm:"primary_key"`
+	Provider        string     `json:"provider" gorm:"index:idx_users_identity"` // the identity provider they log in with
+	Subject         string     `json:"subject" gorm:"index:idx_users_identity"`  // their stable ID at the provider
+	Username        string     `json:"username" gorm:"index"`
+	GithubID        int        `json:"github_id" gorm:"index"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	GerritAccountID int        `json:"gerrit_account_id"`
+	OffboardedAt    *time.Time `json:"offboarded_at"` // when the gerrit account was deactivated (left the org)
+	LastLoginAt     time.Time  `json:"last_login_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"-"`
 }
 
 // InsertUser inserts the user into the database
@@ -16,9 +30,64 @@ func InsertUser(db *gorm.DB, user *User) error {
 	return db.Debug().Create(user).Error
 }
 
-// GetUser returns the user with the specified githubID
+// UpsertUser inserts the user into the database, or updates the existing record for the same user. Users
+// are identified by their ID if it is set, and otherwise by their provider and subject (usernames can change
+// and need not be unique). Github users recorded before the provider and subject were are found by their
+// githubID. The gerrit account ID is preserved if the given user doesn't specify one, as is the offboarding
+// time.
+func UpsertUser(db *gorm.DB, user *User) error {
+	var existing User
+	var err error
+	switch {
+	case user.ID != 0:
+		err = db.First(&existing, user.ID).Error
+	case user.Provider == "" || user.Subject == "":
+		return errors.Errorf("user %s has no provider or subject", user.Username)
+	default:
+		err = db.Where("provider = ? AND subject = ?", user.Provider, user.Subject).First(&existing).Error
+		if err == gorm.ErrRecordNotFound && user.GithubID != 0 {
+			err = db.Where("github_id = ? AND subject = ''", user.GithubID).First(&existing).Error
+		}
+	}
+	if err == gorm.ErrRecordNotFound {
+		return db.Create(user).Error
+	} else if err != nil {
+		return err
+	}
+
+	user.ID = existing.ID
+	user.CreatedAt = existing.CreatedAt
+	if user.GerritAccountID == 0 {
+		user.GerritAccountID = existing.GerritAccountID
+	}
+	if user.OffboardedAt == nil {
+		user.OffboardedAt = existing.OffboardedAt
+	}
+	return db.Save(user).Error
+}
+
+// SetUserOffboarded records when the user was offboarded (nil once they are reactivated)
+func SetUserOffboarded(db *gorm.DB, id uint, at *time.Time) error {
+	return db.Model(&User{}).Where("id = ?", id).UpdateColumn("offboarded_at", at).Error
+}
+
+// FindUser returns the user with the specified githubID
 func FindUser(db *gorm.DB, githubID int) (*User, error) {
 	var user User
-	err := db.Find(&user, githubID).Error
+	err := db.Where("github_id = ?", githubID).First(&user).Error
 	return &user, err
 }
+
+// FindUserByID returns the user with the specified ID
+func FindUserByID(db *gorm.DB, id uint) (*User, error) {
+	var user User
+	err := db.First(&user, id).Error
+	return &user, err
+}
+
+// ListLinkedUsers returns the users that are linked to a (not offboarded) gerrit account
+func ListLinkedUsers(db *gorm.DB) ([]User, error) {
+	var users []User
+	err := db.Where("gerrit_account_id <> 0 AND offboarded_at IS NULL").Order("id").Find(&users).Error
+	return users, err
+}
@@ -1,17 +1,23 @@
 package datastore
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/jinzhu/gorm"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+var inMemoryDBs = 0
+
+// newInMemoeryDB returns a fresh (migrated) in-memory database, so tests don't see each others records
 func newInMemoeryDB() *gorm.DB {
-	db, err := OpenDatabase("sqlite3", "file::memory:?cache=shared")
+	inMemoryDBs++
+	db, err := OpenDatabase("sqlite3", fmt.Sprintf("file:datastore-test-%d?mode=memory&cache=shared", inMemoryDBs))
 	if err != nil {
 		log.Panicln("Failed to create in-memory db:", err)
 	}
@@ -26,6 +32,8 @@ func TestUpsertUser(t *testing.T) {
 	db := newInMemoeryDB()
 
 	user1 := User{
+		Provider: "github",
+		Subject:  "1234",
 		Username: "foobar",
 		GithubID: 1234,
 	}
@@ -34,4 +42,94 @@ func TestUpsertUser(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to upsert user (err: %v): %v", err, user1)
 	}
+
+	// the same github user (renamed) should update the existing record
+	user2 := User{
+		Provider: "github",
+		Subject:  "1234",
+		Username: "foobaz",
+		GithubID: 1234,
+	}
+	if err := UpsertUser(db, &user2); err != nil {
+		t.Errorf("failed to upsert user (err: %v): %v", err, user2)
+	}
+	if user2.ID != user1.ID {
+		t.Errorf("upsert created a new user (id %d) instead of updating %d", user2.ID, user1.ID)
+	}
+
+	found, err := FindUser(db, 1234)
+	if err != nil {
+		t.Errorf("failed to find user: %v", err)
+	} else if found.Username != "foobaz" {
+		t.Errorf("unexpected username after upsert: %s", found.Username)
+	}
+}
+
+func TestUpsertUserBySubject(t *testing.T) {
+	db := newInMemoeryDB()
+
+	alice := User{Provider: "oidc", Subject: "alice-sub", Username: "alice", GerritAccountID: 1000}
+	if err := UpsertUser(db, &alice); err != nil {
+		t.Fatalf("failed to upsert user: %v", err)
+	}
+
+	// someone else (at another provider, or with another subject) taking the username gets a user of their own
+	for _, login := range []User{
+		{Provider: "oidc", Subject: "mallory-sub", Username: "alice"},
+		{Provider: "gitlab", Subject: "alice-sub", Username: "alice"},
+	} {
+		if err := UpsertUser(db, &login); err != nil {
+			t.Fatalf("failed to upsert user: %v", err)
+		}
+		if login.ID == alice.ID || login.GerritAccountID != 0 {
+			t.Errorf("expected %s/%s to get a user of their own, got %+v", login.Provider, login.Subject, login)
+		}
+	}
+
+	// alice changing her username keeps her user
+	renamed := User{Provider: "oidc", Subject: "alice-sub", Username: "alice2"}
+	if err := UpsertUser(db, &renamed); err != nil {
+		t.Fatalf("failed to upsert user: %v", err)
+	}
+	if renamed.ID != alice.ID || renamed.GerritAccountID != 1000 {
+		t.Errorf("expected alice to keep user %d, got %+v", alice.ID, renamed)
+	}
+
+	if err := UpsertUser(db, &User{Username: "nobody"}); err == nil {
+		t.Errorf("expected user without provider and subject to be refused")
+	}
+}
+
+func TestUpsertUserPreservesOffboarding(t *testing.T) {
+	db := newInMemoeryDB()
+
+	user := User{Provider: "github", Subject: "99", Username: "leaver", GithubID: 99, GerritAccountID: 1000}
+	if err := UpsertUser(db, &user); err != nil {
+		t.Fatalf("failed to upsert user: %v", err)
+	}
+	now := time.Now()
+	if err := SetUserOffboarded(db, user.ID, &now); err != nil {
+		t.Fatalf("failed to offboard user: %v", err)
+	}
+
+	// logging in again must not forget the offboarding (or the gerrit account)
+	login := User{Provider: "github", Subject: "99", Username: "leaver", GithubID: 99}
+	if err := UpsertUser(db, &login); err != nil {
+		t.Fatalf("failed to upsert user: %v", err)
+	}
+	if login.OffboardedAt == nil || login.GerritAccountID != 1000 {
+		t.Errorf("expected offboarding and gerrit account to be preserved, got %+v", login)
+	}
+
+	linked, err := ListLinkedUsers(db)
+	if err != nil || len(linked) != 0 {
+		t.Errorf("expected offboarded user not to be listed as linked, got %d (%v)", len(linked), err)
+	}
+	if err := SetUserOffboarded(db, user.ID, nil); err != nil {
+		t.Fatalf("failed to reactivate user: %v", err)
+	}
+	linked, err = ListLinkedUsers(db)
+	if err != nil || len(linked) != 1 {
+		t.Errorf("expected 1 linked user, got %d (%v)", len(linked), err)
+	}
 }
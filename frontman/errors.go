@@ -19,10 +19,24 @@ func handleUnauthorized(w http.ResponseWriter, msg string) {
 	return
 }
 
+func handleForbidden(w http.ResponseWriter, msg string) {
+	log.Println("Forbidden:", msg)
+	gores.JSON(w, http.StatusForbidden, errorResponseBody{Error: msg})
+}
+
 func handleSessionExtractError(w http.ResponseWriter, err error) {
 	msg := "failed to extract auth data from session"
-	if err == http.ErrNoCookie {
+	if err == errInsufficientScope || err == errOffboarded {
+		handleForbidden(w, err.Error())
+		return
+	} else if err == errInvalidAPIToken {
+		msg = err.Error()
+	} else if err == http.ErrNoCookie {
 		msg = "missing auth cookie"
+	} else if err == errInvalidSession {
+		msg = "invalid or expired session"
+	} else if err == errMissingScopes {
+		msg = err.Error()
 	}
 	log.Println(msg)
 	gores.JSON(w, http.StatusUnauthorized, errorResponseBody{Error: msg})
@@ -38,6 +52,11 @@ func handleMissingParam(w http.ResponseWriter, err error) {
 	gores.JSON(w, http.StatusBadRequest, errorResponseBody{Error: err.Error()})
 }
 
+func handleInternalError(w http.ResponseWriter, err error) {
+	log.Println("Internal error:", err)
+	gores.JSON(w, http.StatusInternalServerError, errorResponseBody{Error: err.Error()})
+}
+
 func handleGormError(w http.ResponseWriter, err error) {
 	retcode := http.StatusNotFound
 	if err == gorm.ErrRecordNotFound {
@@ -3,22 +3,30 @@ package main
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	goji "goji.io"
 
 	"goji.io/pat"
 
 	"github.com/alioygur/gores"
+	"github.com/amoghe/polly/frontman/datastore"
 	gerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 )
 
+// gerritRouter is the mux that handles all gerrit related endpoints. The routes must be wrapped by the
+// authentication middleware.
 type gerritRouter struct {
-	cfg            GerritConfig
-	mux            *goji.Mux
-	db             *gorm.DB
-	tokenExtractor TokenExtractor
+	cfg       GerritConfig
+	mux       *goji.Mux
+	db        *gorm.DB
+	imports   *importQueue
+	offboard  *offboarder
+	replicate *replicator
 }
 
 // GerritConfig holds the settings of the backing gerrit server
@@ -26,17 +34,61 @@ type GerritConfig struct {
 	Addr     string
 	Username string
 	Password string
+	// TeamGroups maps Github teams to the Gerrit groups their members are placed in (at login)
+	TeamGroups []TeamMapping
+	// ImportWorkers is the number of repository imports run concurrently
+	ImportWorkers int
+	// MembersGroup is the group (non guest) users are placed in when their account is provisioned
+	MembersGroup string
+	// KeySyncInterval is how often the SSH keys of all users are reconciled with Github (0 disables it)
+	KeySyncInterval time.Duration
+	// OffboardInterval is how often users who left the allowed orgs are offboarded (0 disables it), in dry
+	// runs the offboarding is only reported (in the audit trail)
+	OffboardInterval time.Duration
+	OffboardDryRun   bool
+	// EventsSecret is the secret that gerrit events are signed with (replication is only triggered by events
+	// if it is set)
+	EventsSecret string
+}
+
+// NewClient returns a client for the gerrit server, authenticated as the admin user
+func (c GerritConfig) NewClient() (*gerrit.Client, error) {
+	gclt, err := gerrit.NewClient(c.Addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	gclt.Authentication.SetDigestAuth(c.Username, c.Password)
+	return gclt, nil
+}
+
+// GitURL returns the (authenticated) git over HTTP URL of the gerrit project
+func (c GerritConfig) GitURL(project string) string {
+	addr := strings.TrimSuffix(c.Addr, "/")
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return addr + "/a/" + project
 }
 
 // NewGerritRouter returns a goji.Mux that handles routes pertaining to Gerrit config
-func NewGerritRouter(db *gorm.DB, cfg GerritConfig, te TokenExtractor) http.Handler {
+func NewGerritRouter(db *gorm.DB, cfg GerritConfig, imports *importQueue, offboard *offboarder, replicate *replicator) http.Handler {
 	g := gerritRouter{
-		cfg:            cfg,
-		mux:            goji.SubMux(),
-		db:             db,
-		tokenExtractor: te,
+		cfg:       cfg,
+		mux:       goji.SubMux(),
+		db:        db,
+		imports:   imports,
+		offboard:  offboard,
+		replicate: replicate,
 	}
 	g.mux.HandleFunc(pat.Put("/repositories/:name"), g.ImportRepository)
+	g.mux.HandleFunc(pat.Post("/repositories/:name/replicate"), g.ReplicateRepository)
+	g.mux.HandleFunc(pat.Get("/replication"), g.ListReplicationStatus)
+	g.mux.HandleFunc(pat.Get("/imports"), g.ListImportJobs)
+	g.mux.HandleFunc(pat.Get("/imports/:id"), g.GetImportJob)
+	g.mux.HandleFunc(pat.Delete("/imports/:id"), g.CancelImportJob)
+	g.mux.HandleFunc(pat.Get("/offboarding"), g.ReportOffboarding)
+	g.mux.HandleFunc(pat.Post("/offboarding"), g.RunOffboarding)
+	g.mux.HandleFunc(pat.Get("/audit"), g.ListAuditEvents)
 	return &g
 }
 
@@ -45,7 +97,11 @@ func (g *gerritRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	g.mux.ServeHTTP(w, r)
 }
 
-// ImportRepository creates a project in the polly db and imports the repo into gerrit
+// ImportRepository creates a project (named org/repo) in gerrit and queues a job that imports the contents
+// (all branches and tags) of the Github repo into it, using the callers token. The org query param specifies
+// the org the repo belongs to (it may be omitted if the session was admitted by a single org). The job is
+// returned, its progress can be followed using GetImportJob. Repos that failed to import (or that were imported
+// by earlier versions) may be imported again.
 func (g *gerritRouter) ImportRepository(w http.ResponseWriter, r *http.Request) {
 	repoName := pat.Param(r, "name")
 	if repoName == "" {
@@ -53,28 +109,298 @@ func (g *gerritRouter) ImportRepository(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Println("Setting up gerrit server")
-	gclt, err := gerrit.NewClient(g.cfg.Addr, nil)
+	ident, mem, ok := orgMembershipFromRequest(w, r)
+	if !ok {
+		return
+	}
+	orgName := mem.Org
+	if mem.Role == RoleGuest {
+		handleForbidden(w, "guests of org "+orgName+" may not import repositories")
+		return
+	}
+
+	if ident.Github == nil {
+		handleForbidden(w, "importing repositories requires a Github login")
+		return
+	}
+	repo, _, err := ident.Github.Repositories.Get(orgName, repoName)
 	if err != nil {
-		handleGerritAPIError(w, errors.Wrap(err, "failed to setup client to gerrit server"))
+		handleGithubAPIError(w, err)
+		return
+	}
+	if repo.CloneURL == nil {
+		handleGithubAPIError(w, errors.Errorf("no clone URL for %s/%s", orgName, repoName))
+		return
+	}
+
+	record, err := datastore.FindRepositoryByName(g.db, orgName, repoName)
+	if err == gorm.ErrRecordNotFound {
+		record = &datastore.Repository{
+			OrganizationID: orgName,
+			Name:           repoName,
+			GerritProject:  orgName + "/" + repoName,
+		}
+	} else if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to lookup repository"))
+		return
+	} else if record.Status != datastore.RepositoryFailed && record.Status != datastore.RepositoryLegacy {
+		gores.JSON(w, http.StatusConflict, errorResponseBody{Error: orgName + "/" + repoName + " is already " + record.Status})
+		return
+	}
+
+	if record.ID == 0 {
+		if err := g.createProject(record.GerritProject); err != nil {
+			handleGerritAPIError(w, err)
+			return
+		}
+		log.Println("Created project", record.GerritProject, "for org", orgName)
+	}
+
+	job := datastore.ImportJob{
+		UserID:      ident.User.ID,
+		Org:         orgName,
+		Repo:        repoName,
+		Project:     record.GerritProject,
+		CloneURL:    *repo.CloneURL,
+		AccessToken: ident.Token.AccessToken,
+	}
+	if repo.DefaultBranch != nil {
+		job.DefaultBranch = *repo.DefaultBranch
+	}
+	if repo.Description != nil {
+		job.Description = *repo.Description
+	}
+
+	// the repository is saved before the job is queued, so that the job can't finish before it is recorded
+	record.GithubID = *repo.ID
+	record.GithubCloneURL = *repo.CloneURL
+	record.ImportedBy = ident.User.ID
+	record.Status = datastore.RepositoryImporting
+	if err := datastore.SaveRepository(g.db, record); err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to save repository"))
+		return
+	}
+	if err := g.imports.Enqueue(&job); err != nil {
+		datastore.UpdateRepositoryStatus(g.db, orgName, repoName, datastore.RepositoryFailed, time.Now())
+		handleInternalError(w, err)
 		return
 	}
-	gclt.Authentication.SetDigestAuth(g.cfg.Username, g.cfg.Password)
+	if err := datastore.SetRepositoryImportJob(g.db, record.ID, job.ID); err != nil {
+		log.Println("Failed to record import job", job.ID, "of", orgName+"/"+repoName, ":", err)
+	}
+	log.Println("Queued import job", job.ID, "for", orgName+"/"+repoName)
+	gores.JSON(w, http.StatusAccepted, job)
+}
 
-	proj, resp, err := gclt.Projects.CreateProject(repoName, &gerrit.ProjectInput{
-		Name:              repoName,
+// createProject creates the (empty) project in gerrit
+func (g *gerritRouter) createProject(name string) error {
+	gclt, err := g.cfg.NewClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to setup client to gerrit server")
+	}
+	_, resp, err := gclt.Projects.CreateProject(name, &gerrit.ProjectInput{
+		Name:              name,
 		CreateEmptyCommit: false,
 	})
 	if err != nil {
-		handleGerritAPIError(w, errors.Wrap(err, "failed to create project in gerrit"))
+		return errors.Wrap(err, "failed to create project in gerrit")
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("incorrect response code from gerrit (%d)", resp.StatusCode)
+	}
+	return nil
+}
+
+// ReplicateRepository replicates the (imported) repository back to Github now, rather than waiting for gerrit
+// to report a change. The org query param is handled as in ImportRepository.
+func (g *gerritRouter) ReplicateRepository(w http.ResponseWriter, r *http.Request) {
+	_, mem, ok := orgMembershipFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if mem.Role == RoleGuest {
+		handleForbidden(w, "guests of org "+mem.Org+" may not replicate repositories")
+		return
+	}
+	repo, err := datastore.FindRepositoryByName(g.db, mem.Org, pat.Param(r, "name"))
+	if err == gorm.ErrRecordNotFound {
+		gores.JSON(w, http.StatusNotFound, errorResponseBody{Error: "no such imported repository"})
+		return
+	} else if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to lookup repository"))
+		return
+	}
+	if err := g.replicate.Enqueue(repo); err != nil {
+		gores.JSON(w, http.StatusConflict, errorResponseBody{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ListReplicationStatus lists the (imported) repositories of the org, along with their replication status.
+// The org query param is handled as in ImportRepository.
+func (g *gerritRouter) ListReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	_, mem, ok := orgMembershipFromRequest(w, r)
+	if !ok {
+		return
+	}
+	repos, err := datastore.ListRepositoriesForOrganization(g.db, mem.Org)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to list repositories"))
+		return
+	}
+	gores.JSON(w, http.StatusOK, repos)
+}
+
+// ListImportJobs lists the import jobs started by the caller
+func (g *gerritRouter) ListImportJobs(w http.ResponseWriter, r *http.Request) {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return
+	}
+	jobs, err := datastore.ListImportJobsForUser(g.db, ident.User.ID)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to list import jobs"))
+		return
+	}
+	gores.JSON(w, http.StatusOK, jobs)
+}
+
+// GetImportJob returns the status (and log) of an import job started by the caller
+func (g *gerritRouter) GetImportJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := g.importJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	gores.JSON(w, http.StatusOK, job)
+}
+
+// CancelImportJob cancels a (queued or running) import job started by the caller
+func (g *gerritRouter) CancelImportJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := g.importJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	err := g.imports.Cancel(job.ID)
+	if err == errImportFinished {
+		gores.JSON(w, http.StatusConflict, errorResponseBody{Error: err.Error()})
+		return
+	} else if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to cancel import job"))
+		return
+	}
+	log.Println("Cancelled import job", job.ID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ReportOffboarding reports (dry run) the users that would be offboarded. Only admins may do this.
+func (g *gerritRouter) ReportOffboarding(w http.ResponseWriter, r *http.Request) {
+	g.reconcileOffboarding(w, r, true)
+}
+
+// RunOffboarding offboards the users that left the allowed orgs. Only admins may do this.
+func (g *gerritRouter) RunOffboarding(w http.ResponseWriter, r *http.Request) {
+	g.reconcileOffboarding(w, r, false)
+}
+
+// reconcileOffboarding runs the offboarding reconciliation on behalf of an admin
+func (g *gerritRouter) reconcileOffboarding(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	report, err := g.offboard.Reconcile(r.Context(), dryRun)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to reconcile offboarded users"))
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		handleGerritAPIError(w, errors.Errorf("incorrect response code from gerrit (%d)", resp.StatusCode))
+	gores.JSON(w, http.StatusOK, report)
+}
+
+// ListAuditEvents lists the most recent audit events (the limit query param defaults to 100). Only admins may
+// do this.
+func (g *gerritRouter) ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			handleMissingParam(w, errors.Errorf("invalid limit: %s", raw))
+			return
+		}
+		limit = n
+	}
+	events, err := datastore.ListAuditEvents(g.db, limit)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to list audit events"))
 		return
 	}
-	token, _ := g.tokenExtractor(r)
-	log.Println("Created project", proj.Name)
-	log.Println("Import the repo using token:", token.AccessToken)
-	gores.JSON(w, http.StatusOK, nil)
+	gores.JSON(w, http.StatusOK, events)
+}
+
+// orgMembershipFromRequest returns the callers membership of the org in the org query param (which may be
+// omitted if the caller was admitted by a single org). It writes an error response (and returns false) if
+// the caller was not admitted by the org.
+func orgMembershipFromRequest(w http.ResponseWriter, r *http.Request) (*RequestIdentity, Membership, bool) {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return nil, Membership{}, false
+	}
+	orgName := r.URL.Query().Get("org")
+	if orgName == "" && len(ident.Memberships) == 1 {
+		orgName = ident.Memberships[0].Org
+	}
+	if orgName == "" {
+		handleMissingParam(w, errors.New("org name not specified"))
+		return nil, Membership{}, false
+	}
+	mem, ok := ident.Membership(orgName)
+	if !ok {
+		handleForbidden(w, "session was not admitted via org "+orgName)
+		return nil, Membership{}, false
+	}
+	return ident, mem, true
+}
+
+// requireAdmin writes an error response (and returns false) unless the caller was admitted as an admin
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return false
+	}
+	for _, mem := range ident.Memberships {
+		if mem.Role == RoleAdmin {
+			return true
+		}
+	}
+	handleForbidden(w, "only admins may do this")
+	return false
+}
+
+// importJobFromRequest looks up the import job in the route, writing an error response (and returning false)
+// if there is no such job started by the caller
+func (g *gerritRouter) importJobFromRequest(w http.ResponseWriter, r *http.Request) (*datastore.ImportJob, bool) {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return nil, false
+	}
+	id, err := strconv.ParseUint(pat.Param(r, "id"), 10, 64)
+	if err != nil {
+		handleMissingParam(w, errors.Wrap(err, "invalid import job ID"))
+		return nil, false
+	}
+	job, err := datastore.FindImportJob(g.db, uint(id))
+	if err == gorm.ErrRecordNotFound || (err == nil && job.UserID != ident.User.ID) {
+		gores.JSON(w, http.StatusNotFound, errorResponseBody{Error: "no such import job"})
+		return nil, false
+	} else if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to lookup import job"))
+		return nil, false
+	}
+	return job, true
 }
@@ -1,34 +1,44 @@
 package main
 
 import (
-	"context"
 	"net/http"
 
-	"golang.org/x/oauth2"
-
 	goji "goji.io"
 
 	"github.com/alioygur/gores"
 	"github.com/amoghe/polly/frontman/datastore"
 	"github.com/google/go-github/github"
+	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	"goji.io/pat"
 )
 
-// TokenExtractor is a func that can "extract" a oauth2 Token from the http.Request for an authenticated session
-type TokenExtractor func(r *http.Request) (*oauth2.Token, error)
-
-// githubRouter is the mux that handles all github related endpoints
+// githubRouter is the mux that handles all github related endpoints. The routes must be wrapped by the
+// authentication middleware.
 type githubRouter struct {
-	mux            *goji.Mux
-	tokenExtractor TokenExtractor
+	cfg GithubConfig
+	mux *goji.Mux
+	db  *gorm.DB
+}
+
+// githubRepository is a Github repository, annotated with its status in polly
+type githubRepository struct {
+	Name     string `json:"name"`
+	GithubID int    `json:"github_id"`
+	Private  bool   `json:"private"`
+	// InGerrit is true if the repository has been imported into gerrit, GerritProject and Status are set for
+	// repositories that are (being) imported
+	InGerrit      bool   `json:"in_gerrit"`
+	GerritProject string `json:"gerrit_project,omitempty"`
+	Status        string `json:"status,omitempty"`
 }
 
 // NewGithubRouter returns a mux that is capable of handling all github related routes
-func NewGithubRouter(te TokenExtractor) http.Handler {
+func NewGithubRouter(db *gorm.DB, cfg GithubConfig) http.Handler {
 	g := githubRouter{
-		mux:            goji.SubMux(),
-		tokenExtractor: te,
+		cfg: cfg,
+		mux: goji.SubMux(),
+		db:  db,
 	}
 	g.mux.HandleFunc(pat.Get("/organizations"), g.ListGithubOrganizations)
 	g.mux.HandleFunc(pat.Get("/organizations/:org_name/repositories"), g.ListGithubRepositoriesForOrganization)
@@ -37,65 +47,100 @@ func NewGithubRouter(te TokenExtractor) http.Handler {
 
 // ServeHTTP allows githubRouter to satisfy http.Handler
 func (g *githubRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	clt, err := g.githubClientFromRequest(r)
-	if err != nil {
-		handleUnauthorized(w, "couldn't create github client for current user")
-		return
-	}
-	ctx := context.WithValue(r.Context(), "github-client", clt)
-	g.mux.ServeHTTP(w, r.WithContext(ctx))
+	g.mux.ServeHTTP(w, r)
 }
 
-// return a githubClient from the http request (if its from an authenticated user)
-func (g *githubRouter) githubClientFromRequest(r *http.Request) (*github.Client, error) {
-	token, err := g.tokenExtractor(r)
+// githubIdentityFromRequest returns the identity of the caller, provided it has a Github client
+func githubIdentityFromRequest(r *http.Request) (*RequestIdentity, error) {
+	ident, err := IdentityFromRequest(r)
 	if err != nil {
 		return nil, err
 	}
-	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{
-		AccessToken: token.AccessToken,
-	})
-	httpClient := oauth2.NewClient(r.Context(), tokenSource)
-	return github.NewClient(httpClient), nil
+	if ident.Github == nil {
+		return nil, errors.New("no github client for current user")
+	}
+	return ident, nil
 }
 
-// ListGithubOrganizations returns the authenticated users membership
+// ListGithubOrganizations returns the authenticated users membership (of the orgs that admitted them)
 func (g *githubRouter) ListGithubOrganizations(w http.ResponseWriter, r *http.Request) {
-	client := r.Context().Value("github-client").(*github.Client)
+	ident, err := githubIdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return
+	}
 
 	opt := github.ListOrgMembershipsOptions{State: "active"}
-	mems, _, err := client.Organizations.ListOrgMemberships(&opt)
+	mems, _, err := ident.Github.Organizations.ListOrgMemberships(&opt)
 	if err != nil {
 		handleGithubAPIError(w, err)
 		return
 	}
 
+	ret := []*github.Membership{}
+	for _, mem := range mems {
+		if mem.Organization == nil || mem.Organization.Login == nil {
+			continue
+		}
+		if _, ok := ident.Membership(*mem.Organization.Login); ok {
+			ret = append(ret, mem)
+		}
+	}
+
 	// we'll repurpose github.Membership as our "Organization"
-	gores.JSON(w, http.StatusOK, mems)
+	gores.JSON(w, http.StatusOK, ret)
 }
 
-// ListGithubRepositoriesForOrganization lists repos for a given org membership
+// ListGithubRepositoriesForOrganization lists repos for a given org membership, noting which of them are
+// already in gerrit
 func (g *githubRouter) ListGithubRepositoriesForOrganization(w http.ResponseWriter, r *http.Request) {
-	client := r.Context().Value("github-client").(*github.Client)
-
 	orgName := pat.Param(r, "org_name")
 	if orgName == "" {
 		handleMissingParam(w, errors.New("org name not specified"))
 		return
 	}
 
-	repos, _, err := client.Repositories.ListByOrg(orgName, nil)
+	ident, err := githubIdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return
+	}
+	if _, ok := ident.Membership(orgName); !ok {
+		handleForbidden(w, "session was not admitted via org "+orgName)
+		return
+	}
+
+	repos, _, err := ident.Github.Repositories.ListByOrg(orgName, nil)
 	if err != nil {
 		handleGithubAPIError(w, err)
 		return
 	}
 
-	ret := []datastore.Repository{}
+	known, err := datastore.ListRepositoriesForOrganization(g.db, orgName)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to list imported repositories"))
+		return
+	}
+	imported := map[int]datastore.Repository{}
+	for _, repo := range known {
+		imported[repo.GithubID] = repo
+	}
+
+	ret := []githubRepository{}
 	for _, repo := range repos {
-		ret = append(ret, datastore.Repository{
+		entry := githubRepository{
 			Name:     *repo.Name,
 			GithubID: *repo.ID,
-		})
+		}
+		if repo.Private != nil {
+			entry.Private = *repo.Private
+		}
+		if rec, ok := imported[entry.GithubID]; ok {
+			entry.InGerrit = rec.Status == datastore.RepositoryImported || rec.Status == datastore.RepositoryLegacy
+			entry.GerritProject = rec.GerritProject
+			entry.Status = rec.Status
+		}
+		ret = append(ret, entry)
 	}
 
 	gores.JSON(w, http.StatusOK, ret)
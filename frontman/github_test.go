@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"goji.io"
+	"goji.io/pat"
+)
+
+func TestListGithubRepositories(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/orgs/acme/repos" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1,"name":"widgets-renamed"},{"id":2,"name":"gadgets"},{"id":3,"name":"legacy"}]`))
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	for _, repo := range []datastore.Repository{
+		{OrganizationID: "acme", Name: "widgets", GithubID: 1, GerritProject: "acme/widgets", Status: datastore.RepositoryImported},
+		{OrganizationID: "acme", Name: "gadgets", GithubID: 99, GerritProject: "acme/gadgets", Status: datastore.RepositoryImported},
+		{OrganizationID: "acme", Name: "legacy", GithubID: 3, GerritProject: "legacy", Status: datastore.RepositoryLegacy},
+	} {
+		if err := datastore.InsertRepository(db, &repo); err != nil {
+			t.Fatalf("failed to insert repository: %v", err)
+		}
+	}
+
+	cfg := GithubConfig{URL: srv.URL}
+	client, err := cfg.NewClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident := &RequestIdentity{Memberships: []Membership{{Org: "acme", Role: RoleMember}}, Github: client}
+	mux := goji.NewMux()
+	mux.Handle(pat.New("/github/*"), NewGithubRouter(db, cfg))
+
+	r := httptest.NewRequest("GET", "/github/organizations/acme/repositories", nil)
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, ident))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var repos []githubRepository
+	if err := json.NewDecoder(w.Body).Decode(&repos); err != nil {
+		t.Fatal(err)
+	}
+
+	// repositories are matched by their Github ID, so renamed ones are still found and recreated ones aren't
+	expected := map[string]githubRepository{
+		"widgets-renamed": {Name: "widgets-renamed", GithubID: 1, InGerrit: true, GerritProject: "acme/widgets", Status: datastore.RepositoryImported},
+		"gadgets":         {Name: "gadgets", GithubID: 2},
+		"legacy":          {Name: "legacy", GithubID: 3, InGerrit: true, GerritProject: "legacy", Status: datastore.RepositoryLegacy},
+	}
+	if len(repos) != len(expected) {
+		t.Fatalf("expected %d repositories, got %+v", len(expected), repos)
+	}
+	for _, repo := range repos {
+		if repo != expected[repo.Name] {
+			t.Errorf("expected %+v, got %+v", expected[repo.Name], repo)
+		}
+	}
+}
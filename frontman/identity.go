@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// ProviderGithub authenticates users against Github (members of an org)
+	ProviderGithub = "github"
+	// ProviderGitlab authenticates users against Gitlab (members of a group)
+	ProviderGitlab = "gitlab"
+	// ProviderOIDC authenticates users against a generic OpenID Connect provider
+	ProviderOIDC = "oidc"
+)
+
+const (
+	// RoleMember is the role of regular users, who may import repositories
+	RoleMember = "member"
+	// RoleGuest is the role of users who may look around, but not import repositories
+	RoleGuest = "guest"
+	// RoleAdmin is the role of members who may additionally run administrative tasks (e.g. offboarding)
+	RoleAdmin = "admin"
+)
+
+// errNotAMember is (the cause of) the error providers return for users that none of the allowed orgs (or
+// groups) admit
+var errNotAMember = errors.New("not an active member of any allowed organization or group")
+
+// Identity describes an authenticated user, as reported by the IdentityProvider
+type Identity struct {
+	Provider    string       `json:"provider"`
+	Subject     string       `json:"subject"` // stable (provider specific) user ID
+	Login       string       `json:"login"`
+	Name        string       `json:"name"`
+	Email       string       `json:"email"`
+	AvatarURL   string       `json:"avatar_url"`
+	Groups      []string     `json:"groups"`      // orgs (github), groups (gitlab) or group claims (oidc)
+	Memberships []Membership `json:"memberships"` // the allowed orgs (or groups) that admitted the user
+	Scopes      []string     `json:"scopes"`      // scopes granted to the token (if the provider reports them)
+}
+
+// Membership records an allowed org (or group) that admitted a user, and the role it grants them
+type Membership struct {
+	Org  string `json:"org"`
+	Role string `json:"role"`
+}
+
+// findMembership returns the membership (if any) for the given org. Org names are case insensitive, as they
+// are on Github.
+func findMembership(mems []Membership, org string) (Membership, bool) {
+	for _, mem := range mems {
+		if strings.EqualFold(mem.Org, org) {
+			return mem, true
+		}
+	}
+	return Membership{}, false
+}
+
+// IdentityProvider is the service that users authenticate with (via OAuth2), and which tells us who they are
+// and whether they should be allowed in.
+type IdentityProvider interface {
+	// Name returns the name of the provider (used in routes)
+	Name() string
+	// LoginURL returns the URL to send the user to in order to start the OAuth2 flow
+	LoginURL(state string) string
+	// Exchange converts the authorization code from the callback into a token
+	Exchange(ctx context.Context, code string) (*oauth2.Token, error)
+	// Identity returns the identity (and groups) of the owner of the token
+	Identity(ctx context.Context, tok *oauth2.Token) (*Identity, error)
+	// CheckMembership returns the allowed orgs (or groups) the identity belongs to, or an error if the
+	// identity is not allowed to use polly
+	CheckMembership(ctx context.Context, tok *oauth2.Token, ident *Identity) ([]Membership, error)
+	// CheckScopes returns an error if the granted scopes do not include all the scopes we require (in which
+	// case the user must login again to grant them)
+	CheckScopes(granted []string) error
+}
+
+// GitlabConfig holds the config for our Gitlab app
+type GitlabConfig struct {
+	URL       string // e.g. https://gitlab.com
+	GroupName string // full path of the group users must be members of
+	ClientID  string
+	Secret    string
+}
+
+// OIDCConfig holds the config for our OpenID Connect client
+type OIDCConfig struct {
+	IssuerURL     string
+	ClientID      string
+	Secret        string
+	Scopes        []string
+	GroupsClaim   string // name of the userinfo claim listing the users groups
+	RequiredGroup string // group users must be in (required, the provider may authenticate anyone)
+}
+
+// NewIdentityProvider returns the IdentityProvider selected by the auth config. OAuth2 callbacks are sent to
+// the given redirectURL.
+func NewIdentityProvider(authCfg AuthConfig, githubCfg GithubConfig, redirectURL string) (IdentityProvider, error) {
+	switch authCfg.Provider {
+	case ProviderGithub, "":
+		return newGithubProvider(githubCfg, redirectURL), nil
+	case ProviderGitlab:
+		return newGitlabProvider(authCfg.Gitlab, redirectURL)
+	case ProviderOIDC:
+		return newOIDCProvider(authCfg.OIDC, redirectURL)
+	}
+	return nil, errors.Errorf("unknown identity provider: %s", authCfg.Provider)
+}
+
+// providerTimeout bounds the requests to the (non Github) identity providers
+const providerTimeout = 10 * time.Second
+
+// providerClient returns a client for the (non Github) identity providers whose requests time out. Its requests
+// are authenticated with the token, unless it is nil.
+func providerClient(ctx context.Context, tok *oauth2.Token) *http.Client {
+	if tok == nil {
+		return &http.Client{Timeout: providerTimeout}
+	}
+	client := oauth2.NewClient(ctx, oauth2.StaticTokenSource(tok))
+	client.Timeout = providerTimeout
+	return client
+}
+
+// getJSON GETs the url using the (authenticated) client and decodes the JSON response into v
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{URL: url, StatusCode: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// statusError is the error for unexpected response codes from the providers (non Github) APIs
+type statusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected response code from %s (%d)", e.URL, e.StatusCode)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// githubProvider is the IdentityProvider for Github, it admits active members of the configured orgs
+type githubProvider struct {
+	cfg          GithubConfig
+	oauth2Config oauth2.Config
+}
+
+// newGithubProvider returns an IdentityProvider backed by Github
+func newGithubProvider(cfg GithubConfig, redirectURL string) *githubProvider {
+	scopes := []string{}
+	for _, scope := range cfg.RequiredScopes() {
+		scopes = append(scopes, string(scope))
+	}
+	return &githubProvider{
+		cfg: cfg,
+		oauth2Config: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.Secret,
+			RedirectURL:  redirectURL,
+			Endpoint:     cfg.OAuth2Endpoint(),
+			Scopes:       scopes,
+		},
+	}
+}
+
+// Name returns the name of the provider
+func (p *githubProvider) Name() string {
+	return ProviderGithub
+}
+
+// LoginURL returns the Github URL that starts the OAuth2 flow
+func (p *githubProvider) LoginURL(state string) string {
+	return p.oauth2Config.AuthCodeURL(state)
+}
+
+// Exchange converts the authorization code into a token
+func (p *githubProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	return p.oauth2Config.Exchange(ctx, code)
+}
+
+// Identity returns the Github user (and their orgs) that owns the token. The token must have been granted
+// (at least) the required scopes. The scopes are determined from the response headers of an API call made
+// using the token, this works both for tokens issued to our app and for personal access tokens.
+func (p *githubProvider) Identity(ctx context.Context, tok *oauth2.Token) (*Identity, error) {
+	client, err := p.client(ctx, tok)
+	if err != nil {
+		return nil, err
+	}
+	user, resp, err := client.Users.Get("")
+	if err != nil {
+		return nil, err
+	}
+	scopes := splitScopes(resp.Header.Get("X-OAuth-Scopes"))
+	if err := p.CheckScopes(scopes); err != nil {
+		return nil, err
+	}
+
+	opt := github.ListOrgMembershipsOptions{State: "active"}
+	mems, _, err := client.Organizations.ListOrgMemberships(&opt)
+	if err != nil {
+		return nil, err
+	}
+	orgs := []string{}
+	for _, mem := range mems {
+		if mem.Organization != nil && mem.Organization.Login != nil {
+			orgs = append(orgs, *mem.Organization.Login)
+		}
+	}
+
+	ident := Identity{
+		Provider: ProviderGithub,
+		Subject:  strconv.Itoa(*user.ID),
+		Login:    *user.Login,
+		Groups:   orgs,
+		Scopes:   scopes,
+	}
+	if user.Name != nil {
+		ident.Name = *user.Name
+	}
+	if user.Email != nil {
+		ident.Email = *user.Email // public emails are always verified
+	} else {
+		ident.Email = primaryVerifiedEmail(client)
+	}
+	if user.AvatarURL != nil {
+		ident.AvatarURL = *user.AvatarURL
+	}
+	return &ident, nil
+}
+
+// CheckMembership verifies that the owner of the token is an active member of (at least one of) the allowed
+// orgs, and returns the memberships (with the role each org grants).
+func (p *githubProvider) CheckMembership(ctx context.Context, tok *oauth2.Token, ident *Identity) ([]Membership, error) {
+	client, err := p.client(ctx, tok)
+	if err != nil {
+		return nil, err
+	}
+	mems := []Membership{}
+	for _, org := range p.cfg.Orgs {
+		mem, _, err := client.Organizations.GetOrgMembership("", org.Name)
+		if e, ok := err.(*github.ErrorResponse); ok && e.Response != nil && !isGithubRateLimited(e.Response) &&
+			(e.Response.StatusCode == http.StatusNotFound || e.Response.StatusCode == http.StatusForbidden) {
+			continue // not a member (or the org restricts our app)
+		} else if err != nil {
+			return nil, err
+		}
+		if mem.State == nil || *mem.State != "active" {
+			continue
+		}
+		log.Println("Admitting", ident.Login, "as", org.Role, "via org", org.Name)
+		mems = append(mems, Membership{Org: org.Name, Role: org.Role})
+	}
+	if len(mems) <= 0 {
+		return nil, errNotAMember
+	}
+	return mems, nil
+}
+
+// CheckScopes verifies that the granted scopes include the required ones
+func (p *githubProvider) CheckScopes(granted []string) error {
+	scopes := []github.Scope{}
+	for _, scope := range granted {
+		scopes = append(scopes, github.Scope(scope))
+	}
+	return checkScopes(scopes, p.cfg.RequiredScopes())
+}
+
+// primaryVerifiedEmail returns the primary email of the user, if it is verified. It returns "" if the token was
+// not granted the (optional) user:email scope.
+func primaryVerifiedEmail(client *github.Client) string {
+	emails, _, err := client.Users.ListEmails(nil)
+	if err != nil {
+		return ""
+	}
+	for _, email := range emails {
+		if email.Email != nil && email.Primary != nil && *email.Primary && email.Verified != nil && *email.Verified {
+			return *email.Email
+		}
+	}
+	return ""
+}
+
+// client returns a github client that makes API calls using the users token
+func (p *githubProvider) client(ctx context.Context, tok *oauth2.Token) (*github.Client, error) {
+	tc := oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok.AccessToken}))
+	return p.cfg.NewClient(tc)
+}
+
+// checkScopes verifies that the granted scopes (directly or by implication) include all the required ones.
+func checkScopes(granted, required []github.Scope) error {
+	scopeSet := map[github.Scope]bool{}
+	for _, scope := range granted {
+		scopeSet[scope] = true
+	}
+	for _, scope := range required {
+		if scopeSet[scope] {
+			continue
+		}
+		implied := false
+		for _, broader := range impliedScopes[scope] {
+			implied = implied || scopeSet[broader]
+		}
+		if !implied {
+			return errors.Errorf("auth token is missing scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// isGithubRateLimited returns true if the (403) response is Github throttling us rather than denying access. go-github
+// only recognizes the primary rate limit, its secondary (abuse) limits come back as plain error responses.
+func isGithubRateLimited(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusForbidden &&
+		(resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != "")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// newFakeGithubEnterprise returns a server that fakes the (API and oauth2) endpoints of a Github Enterprise
+// instance, for a user who is an active member of the "acme" org.
+func newFakeGithubEnterprise(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghe-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-OAuth-Scopes", "read:org, read:public_key")
+		writeJSON(w, map[string]interface{}{"id": 42, "login": "octocat", "name": "Mona"})
+	})
+	mux.HandleFunc("/api/v3/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []interface{}{
+			map[string]interface{}{"email": "old@example.com", "primary": false, "verified": true},
+			map[string]interface{}{"email": "mona@example.com", "primary": true, "verified": true},
+		})
+	})
+	mux.HandleFunc("/api/v3/user/memberships/orgs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []interface{}{
+			map[string]interface{}{"state": "active", "organization": map[string]interface{}{"login": "acme"}},
+		})
+	})
+	mux.HandleFunc("/api/v3/user/memberships/orgs/acme", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"state": "active"})
+	})
+	mux.HandleFunc("/api/v3/user/memberships/orgs/other", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]interface{}{"message": "Not Found"})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to fake github: %s", r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestGithubConfigEnterpriseEndpoints(t *testing.T) {
+	cfg := GithubConfig{URL: "https://github.example.com/"}
+
+	ep := cfg.OAuth2Endpoint()
+	if ep.AuthURL != "https://github.example.com/login/oauth/authorize" {
+		t.Errorf("unexpected auth URL: %s", ep.AuthURL)
+	}
+	if ep.TokenURL != "https://github.example.com/login/oauth/access_token" {
+		t.Errorf("unexpected token URL: %s", ep.TokenURL)
+	}
+
+	client, err := cfg.NewClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if client.BaseURL.String() != "https://github.example.com/api/v3/" {
+		t.Errorf("unexpected API base URL: %s", client.BaseURL)
+	}
+}
+
+func TestGithubProviderEnterprise(t *testing.T) {
+	srv := newFakeGithubEnterprise(t)
+	defer srv.Close()
+
+	ctx := context.Background()
+	tok := &oauth2.Token{AccessToken: "ghe-token"}
+	p := newGithubProvider(GithubConfig{Orgs: []GithubOrg{{Name: "acme", Role: RoleMember}}, URL: srv.URL}, "http://localhost/callback")
+
+	ident, err := p.Identity(ctx, tok)
+	if err != nil {
+		t.Fatalf("failed to get identity: %v", err)
+	}
+	if ident.Login != "octocat" || ident.Subject != "42" || ident.Email != "mona@example.com" {
+		t.Errorf("unexpected identity: %+v", ident)
+	}
+	if len(ident.Groups) != 1 || ident.Groups[0] != "acme" {
+		t.Errorf("unexpected orgs: %v", ident.Groups)
+	}
+	if mems, err := p.CheckMembership(ctx, tok, ident); err != nil {
+		t.Errorf("expected member of org to be admitted: %v", err)
+	} else if len(mems) != 1 || mems[0].Org != "acme" || mems[0].Role != RoleMember {
+		t.Errorf("unexpected memberships: %v", mems)
+	}
+
+	p = newGithubProvider(GithubConfig{Orgs: []GithubOrg{{Name: "other", Role: RoleMember}}, URL: srv.URL}, "http://localhost/callback")
+	if _, err := p.CheckMembership(ctx, tok, ident); err == nil {
+		t.Errorf("expected non-member of org to be rejected")
+	}
+}
+
+func TestGithubProviderScopes(t *testing.T) {
+	p := newGithubProvider(GithubConfig{}, "https://frontman.example.com/auth/github/callback")
+	if got := p.oauth2Config.Scopes; !reflect.DeepEqual(got, []string{"read:public_key", "read:org"}) {
+		t.Errorf("expected exactly the default scopes to be requested, got %q", got)
+	}
+	if err := p.CheckScopes([]string{"admin:org", "read:public_key"}); err != nil {
+		t.Errorf("broader scopes should satisfy the default ones: %v", err)
+	}
+
+	cfg := GithubConfig{Scopes: []github.Scope{github.ScopeReadPublicKey, github.ScopeReadOrg, github.ScopeRepo}}
+	p = newGithubProvider(cfg, "https://frontman.example.com/auth/github/callback")
+	if got := p.oauth2Config.Scopes; !reflect.DeepEqual(got, []string{"read:public_key", "read:org", "repo"}) {
+		t.Errorf("expected the configured scopes to be requested, got %q", got)
+	}
+	if err := p.CheckScopes([]string{"read:org", "read:public_key"}); err == nil {
+		t.Errorf("tokens lacking the (newly) required repo scope should be rejected")
+	}
+	if err := p.CheckScopes(nil); err == nil {
+		t.Errorf("sessions without recorded scopes should be rejected")
+	}
+}
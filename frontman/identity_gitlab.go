@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// gitlabScopes are the scopes we need to determine who the user is and which groups they belong to
+var gitlabScopes = []string{"read_user", "read_api"}
+
+// gitlabAccessLevelGuest is the lowest access level that counts as group membership
+const gitlabAccessLevelGuest = 10
+
+// gitlabProvider is the IdentityProvider for Gitlab, it admits active members of the configured group
+type gitlabProvider struct {
+	cfg          GitlabConfig
+	apiURL       string
+	oauth2Config oauth2.Config
+}
+
+// newGitlabProvider returns an IdentityProvider backed by the Gitlab instance in the config
+func newGitlabProvider(cfg GitlabConfig, redirectURL string) (*gitlabProvider, error) {
+	if cfg.URL == "" || cfg.GroupName == "" {
+		return nil, errors.New("gitlab provider needs the instance URL and group name")
+	}
+	base := strings.TrimSuffix(cfg.URL, "/")
+	return &gitlabProvider{
+		cfg:    cfg,
+		apiURL: base + "/api/v4",
+		oauth2Config: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.Secret,
+			RedirectURL:  redirectURL,
+			Endpoint:     oauth2.Endpoint{AuthURL: base + "/oauth/authorize", TokenURL: base + "/oauth/token"},
+			Scopes:       gitlabScopes,
+		},
+	}, nil
+}
+
+// Name returns the name of the provider
+func (p *gitlabProvider) Name() string {
+	return ProviderGitlab
+}
+
+// LoginURL returns the Gitlab URL that starts the OAuth2 flow
+func (p *gitlabProvider) LoginURL(state string) string {
+	return p.oauth2Config.AuthCodeURL(state)
+}
+
+// Exchange converts the authorization code into a token
+func (p *gitlabProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	return p.oauth2Config.Exchange(context.WithValue(ctx, oauth2.HTTPClient, providerClient(ctx, nil)), code)
+}
+
+// Identity returns the Gitlab user (and their groups) that owns the token
+func (p *gitlabProvider) Identity(ctx context.Context, tok *oauth2.Token) (*Identity, error) {
+	client := providerClient(ctx, tok)
+
+	user := struct {
+		ID        int    `json:"id"`
+		Username  string `json:"username"`
+		Name      string `json:"name"`
+		Email     string `json:"email"`
+		AvatarURL string `json:"avatar_url"`
+	}{}
+	if err := getJSON(client, p.apiURL+"/user", &user); err != nil {
+		return nil, errors.Wrap(err, "failed to get gitlab user")
+	}
+
+	groups := []struct {
+		FullPath string `json:"full_path"`
+	}{}
+	groupsURL := fmt.Sprintf("%s/groups?min_access_level=%d&per_page=100", p.apiURL, gitlabAccessLevelGuest)
+	if err := getJSON(client, groupsURL, &groups); err != nil {
+		return nil, errors.Wrap(err, "failed to list gitlab groups")
+	}
+
+	ident := Identity{
+		Provider:  ProviderGitlab,
+		Subject:   strconv.Itoa(user.ID),
+		Login:     user.Username,
+		Name:      user.Name,
+		Email:     user.Email,
+		AvatarURL: user.AvatarURL,
+	}
+	for _, g := range groups {
+		ident.Groups = append(ident.Groups, g.FullPath)
+	}
+	return &ident, nil
+}
+
+// CheckMembership verifies that the owner of the token is an active member of the group (directly or via an
+// ancestor group).
+func (p *gitlabProvider) CheckMembership(ctx context.Context, tok *oauth2.Token, ident *Identity) ([]Membership, error) {
+	client := providerClient(ctx, tok)
+
+	member := struct {
+		State       string `json:"state"`
+		AccessLevel int    `json:"access_level"`
+	}{}
+	memberURL := fmt.Sprintf("%s/groups/%s/members/all/%s", p.apiURL, url.PathEscape(p.cfg.GroupName), ident.Subject)
+	if err := getJSON(client, memberURL, &member); err != nil {
+		if e, ok := err.(*statusError); ok && e.StatusCode == http.StatusNotFound {
+			return nil, errors.Wrapf(errNotAMember, "group %s", p.cfg.GroupName)
+		}
+		return nil, errors.Wrap(err, "failed to lookup group membership")
+	}
+	if member.State != "active" || member.AccessLevel < gitlabAccessLevelGuest {
+		return nil, errors.Wrapf(errNotAMember, "group %s", p.cfg.GroupName)
+	}
+	return []Membership{{Org: p.cfg.GroupName, Role: RoleMember}}, nil
+}
+
+// CheckScopes always succeeds, the scopes we request from Gitlab are fixed
+func (p *gitlabProvider) CheckScopes(granted []string) error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// newFakeGitlab returns a server that fakes the user, groups and group members endpoints of a Gitlab instance,
+// for user 7 (whose membership of the acme/devs group is member, or missing if that is nil)
+func newFakeGitlab(t *testing.T, member map[string]interface{}) *httptest.Server {
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gitlab-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/api/v4/user":
+			writeJSON(w, map[string]interface{}{"id": 7, "username": "tanuki", "name": "Tanuki", "email": "tanuki@example.com"})
+		case "/api/v4/groups":
+			writeJSON(w, []interface{}{map[string]interface{}{"full_path": "acme"}, map[string]interface{}{"full_path": "acme/devs"}})
+		case "/api/v4/groups/acme%2Fdevs/members/all/7":
+			if member == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeJSON(w, member)
+		default:
+			t.Errorf("unexpected request to fake gitlab: %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestGitlabProvider(t *testing.T) {
+	if _, err := newGitlabProvider(GitlabConfig{URL: "https://gitlab.example.com"}, "http://localhost/callback"); err == nil {
+		t.Errorf("expected provider without group to be refused")
+	}
+
+	tests := []struct {
+		name   string
+		member map[string]interface{}
+		admit  bool
+	}{
+		{"member", map[string]interface{}{"state": "active", "access_level": 30}, true},
+		{"guest", map[string]interface{}{"state": "active", "access_level": 10}, true},
+		{"minimal access", map[string]interface{}{"state": "active", "access_level": 5}, false},
+		{"blocked", map[string]interface{}{"state": "blocked", "access_level": 30}, false},
+		{"not a member", nil, false},
+	}
+	for _, tc := range tests {
+		srv := newFakeGitlab(t, tc.member)
+		p, err := newGitlabProvider(GitlabConfig{URL: srv.URL + "/", GroupName: "acme/devs"}, "http://localhost/callback")
+		if err != nil {
+			t.Fatalf("failed to create provider: %v", err)
+		}
+		tok := &oauth2.Token{AccessToken: "gitlab-token"}
+		ident, err := p.Identity(context.Background(), tok)
+		if err != nil {
+			t.Fatalf("%s: failed to get identity: %v", tc.name, err)
+		}
+		want := Identity{Provider: ProviderGitlab, Subject: "7", Login: "tanuki", Name: "Tanuki", Email: "tanuki@example.com",
+			Groups: []string{"acme", "acme/devs"}}
+		if !reflect.DeepEqual(*ident, want) {
+			t.Errorf("%s: expected identity %+v, got %+v", tc.name, want, *ident)
+		}
+
+		mems, err := p.CheckMembership(context.Background(), tok, ident)
+		if tc.admit && (err != nil || !reflect.DeepEqual(mems, []Membership{{Org: "acme/devs", Role: RoleMember}})) {
+			t.Errorf("%s: expected to be admitted, got %v (%v)", tc.name, mems, err)
+		} else if !tc.admit && errors.Cause(err) != errNotAMember {
+			t.Errorf("%s: expected %v, got %v", tc.name, errNotAMember, err)
+		}
+		srv.Close()
+	}
+
+	// failures of the Gitlab instance are not mistaken for users that aren't members
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	p, _ := newGitlabProvider(GitlabConfig{URL: srv.URL, GroupName: "acme/devs"}, "http://localhost/callback")
+	_, err := p.CheckMembership(context.Background(), &oauth2.Token{AccessToken: "gitlab-token"}, &Identity{Subject: "7"})
+	if err == nil || errors.Cause(err) == errNotAMember || isDefinitiveVerificationError(err) {
+		t.Errorf("expected a transient error, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// newFakeOIDC returns a server that fakes the discovery and userinfo endpoints of an OpenID Connect provider,
+// whose userinfo endpoint returns the claims for the "oidc-token" access token.
+func newFakeOIDC(t *testing.T, claims map[string]interface{}) *httptest.Server {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer oidc-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, claims)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to fake oidc provider: %s", r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func TestOIDCProviderEmailVerified(t *testing.T) {
+	tests := []struct {
+		name     string
+		verified interface{}
+		email    string
+	}{
+		{"verified", true, "mona@example.com"},
+		{"verified (as string)", "true", "mona@example.com"},
+		{"unverified", false, ""},
+		{"unverified (as string)", "false", ""},
+		{"no verification claim", nil, ""},
+	}
+	for _, tc := range tests {
+		claims := map[string]interface{}{"sub": "mona-sub", "preferred_username": "mona", "email": "mona@example.com"}
+		if tc.verified != nil {
+			claims["email_verified"] = tc.verified
+		}
+		srv := newFakeOIDC(t, claims)
+		p, err := newOIDCProvider(OIDCConfig{IssuerURL: srv.URL, ClientID: "frontman", RequiredGroup: "devs"},
+			"http://localhost/callback")
+		if err != nil {
+			t.Fatalf("failed to create provider: %v", err)
+		}
+		ident, err := p.Identity(context.Background(), &oauth2.Token{AccessToken: "oidc-token"})
+		if err != nil {
+			t.Fatalf("%s: failed to get identity: %v", tc.name, err)
+		}
+		if ident.Subject != "mona-sub" || ident.Login != "mona" || ident.Email != tc.email {
+			t.Errorf("%s: expected email %q, got %+v", tc.name, tc.email, ident)
+		}
+		srv.Close()
+	}
+}
+
+func TestOIDCProvider(t *testing.T) {
+	srv := newFakeOIDC(t, map[string]interface{}{"sub": "mona-sub", "name": "Mona", "roles": []interface{}{"devs", 42, "ops"}})
+	defer srv.Close()
+
+	configs := map[string]OIDCConfig{
+		"no issuer":         {RequiredGroup: "devs"},
+		"no required group": {IssuerURL: srv.URL},
+		"issuer mismatch":   {IssuerURL: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), RequiredGroup: "devs"},
+	}
+	for name, cfg := range configs {
+		if _, err := newOIDCProvider(cfg, "http://localhost/callback"); err == nil {
+			t.Errorf("%s: expected provider to be refused", name)
+		}
+	}
+
+	p, err := newOIDCProvider(OIDCConfig{IssuerURL: srv.URL + "/", GroupsClaim: "roles", RequiredGroup: "devs"},
+		"http://localhost/callback")
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	tok := &oauth2.Token{AccessToken: "oidc-token"}
+	ident, err := p.Identity(context.Background(), tok)
+	if err != nil {
+		t.Fatalf("failed to get identity: %v", err)
+	}
+	want := Identity{Provider: ProviderOIDC, Subject: "mona-sub", Login: "mona-sub", Name: "Mona", Groups: []string{"devs", "ops"}}
+	if !reflect.DeepEqual(*ident, want) {
+		t.Errorf("expected identity %+v, got %+v", want, *ident)
+	}
+	if mems, err := p.CheckMembership(context.Background(), tok, ident); err != nil ||
+		!reflect.DeepEqual(mems, []Membership{{Org: "devs", Role: RoleMember}}) {
+		t.Errorf("expected to be admitted via devs, got %v (%v)", mems, err)
+	}
+
+	ident.Groups = []string{"ops"}
+	if _, err := p.CheckMembership(context.Background(), tok, ident); errors.Cause(err) != errNotAMember {
+		t.Errorf("expected %v, got %v", errNotAMember, err)
+	}
+	if _, err := p.Identity(context.Background(), &oauth2.Token{AccessToken: "revoked"}); err == nil {
+		t.Errorf("expected identity of revoked token to fail")
+	}
+}
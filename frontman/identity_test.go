@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestFindMembership(t *testing.T) {
+	mems := []Membership{{Org: "acme", Role: RoleMember}, {Org: "Widgets", Role: RoleAdmin}}
+	tests := []struct {
+		org  string
+		role string // empty if there is no membership
+	}{
+		{"acme", RoleMember},
+		{"Acme", RoleMember},
+		{"widgets", RoleAdmin},
+		{"WIDGETS", RoleAdmin},
+		{"acme-corp", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		mem, ok := findMembership(mems, tc.org)
+		if ok != (tc.role != "") || mem.Role != tc.role {
+			t.Errorf("%q: expected role %q, got %+v (%v)", tc.org, tc.role, mem, ok)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/pkg/errors"
+)
+
+// askpassScript is handed to git (as GIT_ASKPASS) to answer credential prompts. The credentials are passed in
+// the environment of the git process, so they never appear on its command line, on disk or in the logs.
+const askpassScript = `#!/bin/sh
+case "$1" in
+Username*) echo "$POLLY_GIT_USERNAME" ;;
+*) echo "$POLLY_GIT_PASSWORD" ;;
+esac
+`
+
+// gitRemote is a git repository along with the credentials (if any) needed to access it
+type gitRemote struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// repoImporter mirrors git repositories (all branches and tags) from one remote to another, using the git
+// binary. Each import is done in a scratch directory that is removed afterwards.
+type repoImporter struct {
+	git     string // path to the git binary
+	workDir string // where the scratch directories are created (empty for the default temp dir)
+}
+
+// newRepoImporter returns a repoImporter that works in (scratch directories under) workDir
+func newRepoImporter(workDir string) *repoImporter {
+	return &repoImporter{
+		git:     "git",
+		workDir: workDir,
+	}
+}
+
+// Import mirror clones the src repository and pushes its branches and tags to the dst repository. The progress
+// func (if any) is told when each stage (cloning, pushing) starts.
+func (im *repoImporter) Import(ctx context.Context, src, dst gitRemote, progress func(stage string)) error {
+	if progress == nil {
+		progress = func(string) {}
+	}
+
+	dir, askpass, err := im.scratchDir("import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	mirror := filepath.Join(dir, "repo.git")
+	progress(datastore.ImportCloning)
+	if err := im.run(ctx, dir, askpass, src, "clone", "--mirror", "--quiet", src.URL, mirror); err != nil {
+		return errors.Wrap(err, "failed to clone repository")
+	}
+	progress(datastore.ImportPushing)
+	err = im.run(ctx, mirror, askpass, dst, "push", "--quiet", dst.URL, "refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+	if err != nil {
+		return errors.Wrap(err, "failed to push repository")
+	}
+	return nil
+}
+
+// Sync is like Import, except that refs which can't be fast-forwarded on dst (because they diverged, or are
+// tags that were moved) don't fail it. Those refs are left alone, and returned instead.
+func (im *repoImporter) Sync(ctx context.Context, src, dst gitRemote) ([]string, error) {
+	dir, askpass, err := im.scratchDir("sync-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	mirror := filepath.Join(dir, "repo.git")
+	if err := im.run(ctx, dir, askpass, src, "clone", "--mirror", "--quiet", src.URL, mirror); err != nil {
+		return nil, errors.Wrap(err, "failed to clone repository")
+	}
+	out, pushErr := im.output(ctx, mirror, askpass, dst, "push", "--porcelain", dst.URL, "refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+	diverged, failed := parsePushStatus(out)
+	if pushErr != nil && (len(diverged) <= 0 || failed) {
+		return nil, errors.Wrap(pushErr, "failed to push repository")
+	}
+	return diverged, nil
+}
+
+// scratchDir creates a scratch directory (which the caller must remove) containing the askpass helper
+func (im *repoImporter) scratchDir(prefix string) (string, string, error) {
+	dir, err := ioutil.TempDir(im.workDir, prefix)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to create scratch dir")
+	}
+	askpass := filepath.Join(dir, "askpass.sh")
+	if err := ioutil.WriteFile(askpass, []byte(askpassScript), 0700); err != nil {
+		os.RemoveAll(dir)
+		return "", "", errors.Wrap(err, "failed to write askpass helper")
+	}
+	return dir, askpass, nil
+}
+
+// parsePushStatus returns the refs that were rejected (as non fast-forwards) by a git push --porcelain, and
+// whether the push failed for other reasons (e.g. refs rejected by the remote's hooks or permissions)
+func parsePushStatus(out string) ([]string, bool) {
+	diverged := []string{}
+	failed := false
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		// <flag> TAB <from>:<to> TAB <summary> (<reason>)
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 || fields[0] != "!" {
+			continue
+		}
+		if !strings.HasPrefix(fields[2], "[rejected]") {
+			failed = true
+			continue
+		}
+		if i := strings.Index(fields[1], ":"); i >= 0 {
+			diverged = append(diverged, fields[1][i+1:])
+		}
+	}
+	return diverged, failed
+}
+
+// run runs git (in dir) with the given args, using the credentials of the remote. The output of failed runs
+// is included in the error, with the credentials redacted.
+func (im *repoImporter) run(ctx context.Context, dir, askpass string, remote gitRemote, args ...string) error {
+	_, err := im.output(ctx, dir, askpass, remote, args...)
+	return err
+}
+
+// output is like run, but also returns the (redacted) output of git
+func (im *repoImporter) output(ctx context.Context, dir, askpass string, remote gitRemote, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, im.git, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_ASKPASS="+askpass,
+		"GIT_TERMINAL_PROMPT=0",
+		"POLLY_GIT_USERNAME="+remote.Username,
+		"POLLY_GIT_PASSWORD="+remote.Password,
+	)
+	out, err := cmd.CombinedOutput()
+	msg := strings.TrimSpace(string(out))
+	if remote.Password != "" {
+		msg = strings.Replace(msg, remote.Password, "<redacted>", -1)
+	}
+	if err != nil {
+		return msg, errors.Errorf("git %s: %v: %s", args[0], err, msg)
+	}
+	return msg, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+)
+
+// git runs git in dir, failing the test on errors
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=polly", "GIT_AUTHOR_EMAIL=polly@example.com",
+		"GIT_COMMITTER_NAME=polly", "GIT_COMMITTER_EMAIL=polly@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestRepoImporter(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir, err := ioutil.TempDir("", "importer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a bare repo (standing in for Github) with two branches and a tag
+	github := filepath.Join(dir, "github.git")
+	work := filepath.Join(dir, "work")
+	git(t, dir, "init", "--quiet", "--bare", github)
+	git(t, dir, "init", "--quiet", work)
+	git(t, work, "commit", "--quiet", "--allow-empty", "-m", "first")
+	git(t, work, "tag", "v1")
+	git(t, work, "checkout", "--quiet", "-b", "feature")
+	git(t, work, "commit", "--quiet", "--allow-empty", "-m", "second")
+	git(t, work, "push", "--quiet", github, "--all")
+	git(t, work, "push", "--quiet", github, "--tags")
+
+	// an empty bare repo (standing in for the new Gerrit project)
+	gerrit := filepath.Join(dir, "gerrit.git")
+	git(t, dir, "init", "--quiet", "--bare", gerrit)
+
+	im := newRepoImporter(dir)
+	src := gitRemote{URL: github, Username: "x-access-token", Password: "s3cret"}
+	stages := []string{}
+	progress := func(stage string) { stages = append(stages, stage) }
+	if err := im.Import(context.Background(), src, gitRemote{URL: gerrit}, progress); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if want := []string{datastore.ImportCloning, datastore.ImportPushing}; !reflect.DeepEqual(stages, want) {
+		t.Errorf("expected stages %q, got %q", want, stages)
+	}
+
+	want := git(t, github, "for-each-ref", "--format=%(refname) %(objectname)")
+	got := git(t, gerrit, "for-each-ref", "--format=%(refname) %(objectname)")
+	if !reflect.DeepEqual(strings.Split(got, "\n"), strings.Split(want, "\n")) {
+		t.Errorf("expected refs:\n%s\ngot:\n%s", want, got)
+	}
+
+	// failures are reported, without the credentials
+	src.URL = filepath.Join(dir, "s3cret-missing.git")
+	err = im.Import(context.Background(), src, gitRemote{URL: gerrit}, nil)
+	if err == nil {
+		t.Fatalf("expected import of missing repository to fail")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error leaks credentials: %v", err)
+	}
+}
+
+func TestRepoImporterSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir, err := ioutil.TempDir("", "importer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Github and gerrit start out identical, with a master and a hotfix branch
+	github := filepath.Join(dir, "github.git")
+	gerrit := filepath.Join(dir, "gerrit.git")
+	work := filepath.Join(dir, "work")
+	git(t, dir, "init", "--quiet", "--bare", github)
+	git(t, dir, "init", "--quiet", "--bare", gerrit)
+	git(t, dir, "init", "--quiet", work)
+	git(t, work, "checkout", "--quiet", "-b", "master")
+	git(t, work, "commit", "--quiet", "--allow-empty", "-m", "first")
+	git(t, work, "branch", "hotfix")
+	git(t, work, "push", "--quiet", github, "--all")
+	git(t, work, "push", "--quiet", gerrit, "--all")
+
+	// a change is submitted in gerrit, while master and the hotfix branch are pushed to on Github
+	git(t, work, "commit", "--quiet", "--allow-empty", "-m", "submitted")
+	git(t, work, "push", "--quiet", gerrit, "master")
+	submitted := git(t, work, "rev-parse", "HEAD")
+	git(t, work, "reset", "--quiet", "--hard", "HEAD~1")
+	git(t, work, "commit", "--quiet", "--allow-empty", "-m", "pushed to github")
+	git(t, work, "push", "--quiet", github, "master")
+	git(t, work, "checkout", "--quiet", "hotfix")
+	git(t, work, "commit", "--quiet", "--allow-empty", "-m", "hotfix")
+	git(t, work, "push", "--quiet", github, "hotfix")
+	hotfix := git(t, work, "rev-parse", "HEAD")
+
+	im := newRepoImporter(dir)
+	diverged, err := im.Sync(context.Background(), gitRemote{URL: github}, gitRemote{URL: gerrit})
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if want := []string{"refs/heads/master"}; !reflect.DeepEqual(diverged, want) {
+		t.Errorf("expected diverged refs %q, got %q", want, diverged)
+	}
+	if got := git(t, gerrit, "rev-parse", "hotfix"); got != hotfix {
+		t.Errorf("expected hotfix to be fast-forwarded to %s, got %s", hotfix, got)
+	}
+	if got := git(t, gerrit, "rev-parse", "master"); got != submitted {
+		t.Errorf("expected diverged master to be left at %s, got %s", submitted, got)
+	}
+}
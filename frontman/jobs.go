@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultImportWorkers is the number of imports run concurrently, unless configured otherwise
+	defaultImportWorkers = 2
+	// importPollInterval is how often idle workers look for queued jobs (in case a wakeup was missed)
+	importPollInterval = time.Minute
+	// importTokenSealName is what the importers token is sealed for (like a cookie name)
+	importTokenSealName = "import-job"
+)
+
+var (
+	// errImportFinished is returned when cancelling a job that has already finished
+	errImportFinished = errors.New("import job has already finished")
+)
+
+// projectImporter copies a Github repository into a gerrit project (it is the repoImporter, except in tests)
+type projectImporter interface {
+	Import(ctx context.Context, src, dst gitRemote, progress func(stage string)) error
+}
+
+// importQueue runs import jobs (persisted in the datastore) in the background, using a bounded pool of
+// workers. Jobs that were running when the server stopped are started afresh when it starts again.
+type importQueue struct {
+	db        *gorm.DB
+	gerritCfg GerritConfig
+	importer  projectImporter
+	replicate *replicator   // verifies (by replicating) that imported repositories can be replicated
+	sealer    *cookieSealer // seals the importers tokens while they are stored
+	workers   int
+	wake      chan struct{}
+
+	mu      sync.Mutex                  // serializes claiming and cancelling jobs
+	cancels map[uint]context.CancelFunc // of the running jobs
+}
+
+// newImportQueue returns an importQueue that imports into the gerrit server in the config
+func newImportQueue(db *gorm.DB, gerritCfg GerritConfig, importer projectImporter, replicate *replicator,
+	sealer *cookieSealer) *importQueue {
+	workers := gerritCfg.ImportWorkers
+	if workers <= 0 {
+		workers = defaultImportWorkers
+	}
+	return &importQueue{
+		db:        db,
+		gerritCfg: gerritCfg,
+		importer:  importer,
+		replicate: replicate,
+		sealer:    sealer,
+		workers:   workers,
+		wake:      make(chan struct{}, workers),
+		cancels:   map[uint]context.CancelFunc{},
+	}
+}
+
+// Start requeues the jobs interrupted by a restart and starts the workers
+func (q *importQueue) Start() error {
+	if err := datastore.RequeueRunningImportJobs(q.db); err != nil {
+		return errors.Wrap(err, "failed to requeue interrupted import jobs")
+	}
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+	q.notify()
+	return nil
+}
+
+// Enqueue saves the (new) job in the queued state (with its token sealed) and wakes up a worker to run it
+func (q *importQueue) Enqueue(job *datastore.ImportJob) error {
+	sealed, err := q.sealer.SealToken(importTokenSealName, job.AccessToken)
+	if err != nil {
+		return errors.Wrap(err, "failed to seal import token")
+	}
+	job.AccessToken = sealed
+	job.State = datastore.ImportQueued
+	if err := datastore.InsertImportJob(q.db, job); err != nil {
+		return errors.Wrap(err, "failed to save import job")
+	}
+	q.notify()
+	return nil
+}
+
+// Cancel cancels the job, whether it is queued or running
+func (q *importQueue) Cancel(id uint) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := datastore.CancelQueuedImportJob(q.db, id, time.Now())
+	if err == nil {
+		job, err := datastore.FindImportJob(q.db, id)
+		if err != nil {
+			return err
+		}
+		q.recordOutcome(job)
+		return nil
+	} else if err != gorm.ErrRecordNotFound {
+		return err
+	}
+	cancel, ok := q.cancels[id]
+	if !ok {
+		return errImportFinished
+	}
+	cancel()
+	return nil
+}
+
+// notify wakes up an idle worker (if any)
+func (q *importQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work runs queued jobs (one at a time) until the process exits
+func (q *importQueue) work() {
+	for {
+		job, ctx, err := q.claim()
+		if err == gorm.ErrRecordNotFound {
+			select {
+			case <-q.wake:
+			case <-time.After(importPollInterval):
+			}
+			continue
+		} else if err != nil {
+			log.Println("[IMPORT] Failed to claim import job:", err)
+			time.Sleep(importPollInterval)
+			continue
+		}
+		q.run(ctx, job)
+	}
+}
+
+// claim claims the next queued job, returning it along with the context (cancelled by Cancel) to run it in
+func (q *importQueue) claim() (*datastore.ImportJob, context.Context, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := datastore.ClaimNextImportJob(q.db, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancels[job.ID] = cancel
+	return job, ctx, nil
+}
+
+// run runs the (claimed) job to completion, recording its progress in the datastore
+func (q *importQueue) run(ctx context.Context, job *datastore.ImportJob) {
+	defer func() {
+		q.mu.Lock()
+		q.cancels[job.ID]()
+		delete(q.cancels, job.ID)
+		q.mu.Unlock()
+	}()
+
+	q.logf(job, "Importing %s/%s into project %s", job.Org, job.Repo, job.Project)
+	err := q.runStages(ctx, job)
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.AccessToken = ""
+	switch {
+	case ctx.Err() == context.Canceled:
+		job.State = datastore.ImportCancelled
+		q.logf(job, "Cancelled")
+	case err != nil:
+		job.State = datastore.ImportFailed
+		job.Error = err.Error()
+		q.logf(job, "Failed: %s", err)
+	default:
+		job.State = datastore.ImportDone
+		q.logf(job, "Done")
+	}
+	q.recordOutcome(job)
+}
+
+// recordOutcome updates the status of the repository the (finished) job imported
+func (q *importQueue) recordOutcome(job *datastore.ImportJob) {
+	status := datastore.RepositoryFailed
+	if job.State == datastore.ImportDone {
+		status = datastore.RepositoryImported
+	}
+	if err := datastore.UpdateRepositoryStatus(q.db, job.Org, job.Repo, status, time.Now()); err != nil {
+		log.Println("[IMPORT] Failed to update repository of import job", job.ID, ":", err)
+		return
+	}
+	if status != datastore.RepositoryImported {
+		return
+	}
+	// replicate the freshly imported project right away (a no-op push), so that a deploy credential that can't
+	// push to the Github repository shows up in its replication status
+	repo, err := datastore.FindRepositoryByName(q.db, job.Org, job.Repo)
+	if err == nil {
+		err = q.replicate.Enqueue(repo)
+	}
+	if err != nil {
+		log.Println("[IMPORT] Failed to enable replication of", job.Project, ":", err)
+	}
+}
+
+// runStages clones, pushes and configures the project
+func (q *importQueue) runStages(ctx context.Context, job *datastore.ImportJob) error {
+	token, err := q.sealer.OpenToken(importTokenSealName, job.AccessToken)
+	if err != nil {
+		return errors.Wrap(err, "failed to open import token")
+	}
+	src := gitRemote{URL: job.CloneURL, Username: "x-access-token", Password: token}
+	dst := gitRemote{URL: q.gerritCfg.GitURL(job.Project), Username: q.gerritCfg.Username, Password: q.gerritCfg.Password}
+	progress := func(stage string) {
+		job.State = stage
+		q.logf(job, "Stage: %s", stage)
+	}
+	if err := q.importer.Import(ctx, src, dst, progress); err != nil {
+		return err
+	}
+
+	progress(datastore.ImportConfiguring)
+	gclt, err := q.gerritCfg.NewClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to setup client to gerrit server")
+	}
+	if job.DefaultBranch != "" {
+		head := gerrit.HeadInput{Ref: "refs/heads/" + job.DefaultBranch}
+		if _, _, err := gclt.Projects.SetHEAD(job.Project, &head); err != nil {
+			return errors.Wrap(err, "failed to set project HEAD")
+		}
+	}
+	if job.Description != "" {
+		desc := gerrit.ProjectDescriptionInput{Description: job.Description, CommitMessage: "Imported from Github"}
+		if _, _, err := gclt.Projects.SetProjectDescription(job.Project, &desc); err != nil {
+			return errors.Wrap(err, "failed to set project description")
+		}
+	}
+	return nil
+}
+
+// logf appends the (timestamped) message to the job log and saves the job
+func (q *importQueue) logf(job *datastore.ImportJob, format string, args ...interface{}) {
+	line := fmt.Sprintf("%s %s\n", time.Now().UTC().Format(time.RFC3339), strings.TrimSpace(fmt.Sprintf(format, args...)))
+	job.Log += line
+	log.Printf("[IMPORT] job %d: %s", job.ID, strings.TrimSpace(line))
+	if err := datastore.SaveImportJob(q.db, job); err != nil {
+		log.Println("[IMPORT] Failed to save import job", job.ID, ":", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/jinzhu/gorm"
+)
+
+// stubImporter records the imports it is asked to run instead of running git. Blocking imports wait until
+// they are cancelled.
+type stubImporter struct {
+	mu      sync.Mutex
+	tokens  []string    // the source credentials of the imports
+	started chan string // receives the source URL of every import as it starts (if set)
+	block   bool
+	err     error
+}
+
+func (s *stubImporter) Import(ctx context.Context, src, dst gitRemote, progress func(stage string)) error {
+	progress(datastore.ImportCloning)
+	s.mu.Lock()
+	s.tokens = append(s.tokens, src.Password)
+	s.mu.Unlock()
+	if s.started != nil {
+		s.started <- src.URL
+	}
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	progress(datastore.ImportPushing)
+	return s.err
+}
+
+func (s *stubImporter) importedTokens() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.tokens...)
+}
+
+// newTestImportQueue returns an (unstarted) import queue that runs its imports with the importer, along with
+// its database
+func newTestImportQueue(t *testing.T, importer projectImporter) (*importQueue, *gorm.DB) {
+	db := newTestDB(t)
+	db.DB().SetMaxOpenConns(1) // the workers share the in-memory database with the test
+	srv := httptest.NewServer(newFakeGerrit())
+	t.Cleanup(srv.Close)
+	sealer, err := newCookieSealer([][]byte{[]byte("secret")})
+	if err != nil {
+		t.Fatalf("failed to create sealer: %v", err)
+	}
+	gerritCfg := GerritConfig{Addr: srv.URL, Username: "admin", Password: "secret", ImportWorkers: 2}
+	replicate := newReplicator(db, GithubConfig{}, gerritCfg, nil) // not started, imports only queue replication
+	return newImportQueue(db, gerritCfg, importer, replicate, sealer), db
+}
+
+// enqueueImport records the repository as importing and queues the job that imports it
+func enqueueImport(t *testing.T, q *importQueue, name string) *datastore.ImportJob {
+	repo := datastore.Repository{OrganizationID: "acme", Name: name, GerritProject: "acme/" + name, Status: datastore.RepositoryImporting}
+	if err := datastore.InsertRepository(q.db, &repo); err != nil {
+		t.Fatalf("failed to insert repository: %v", err)
+	}
+	job := datastore.ImportJob{
+		Org:         "acme",
+		Repo:        name,
+		Project:     repo.GerritProject,
+		CloneURL:    "https://github.com/acme/" + name + ".git",
+		AccessToken: "gho_" + name,
+	}
+	if err := q.Enqueue(&job); err != nil {
+		t.Fatalf("failed to enqueue job: %v", err)
+	}
+	return &job
+}
+
+// waitForJob waits until the job has finished, and returns it
+func waitForJob(t *testing.T, db *gorm.DB, id uint) *datastore.ImportJob {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := datastore.FindImportJob(db, id)
+		if err == nil && job.Finished() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for job %d (%+v, %v)", id, job, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImportQueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantState   string
+		wantStatus  string
+		replication string
+	}{
+		{"done", nil, datastore.ImportDone, datastore.RepositoryImported, datastore.ReplicationPending},
+		{"failed", context.DeadlineExceeded, datastore.ImportFailed, datastore.RepositoryFailed, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			importer := &stubImporter{err: tc.err}
+			q, db := newTestImportQueue(t, importer)
+			if err := q.Start(); err != nil {
+				t.Fatalf("failed to start queue: %v", err)
+			}
+			job := enqueueImport(t, q, "widgets")
+
+			stored, _ := datastore.FindImportJob(db, job.ID)
+			if stored.AccessToken == "" || stored.AccessToken == "gho_widgets" {
+				t.Errorf("expected the queued token to be sealed, got %q", stored.AccessToken)
+			}
+
+			job = waitForJob(t, db, job.ID)
+			if job.State != tc.wantState || job.AccessToken != "" || job.StartedAt == nil {
+				t.Errorf("expected job %s (without token), got %+v", tc.wantState, job)
+			}
+			if (job.Error != "") != (tc.err != nil) {
+				t.Errorf("unexpected job error: %q", job.Error)
+			}
+			if tokens := importer.importedTokens(); len(tokens) != 1 || tokens[0] != "gho_widgets" {
+				t.Errorf("expected one import with the (opened) token, got %q", tokens)
+			}
+			repo, _ := datastore.FindRepositoryByName(db, "acme", "widgets")
+			if repo.Status != tc.wantStatus || repo.ReplicationStatus != tc.replication {
+				t.Errorf("expected repository %s (replication %q), got %+v", tc.wantStatus, tc.replication, repo)
+			}
+		})
+	}
+}
+
+func TestImportQueueCancel(t *testing.T) {
+	// queued jobs are cancelled without running
+	importer := &stubImporter{}
+	q, db := newTestImportQueue(t, importer)
+	job := enqueueImport(t, q, "queued")
+	if err := q.Cancel(job.ID); err != nil {
+		t.Fatalf("failed to cancel queued job: %v", err)
+	}
+	if job, _ = datastore.FindImportJob(db, job.ID); job.State != datastore.ImportCancelled {
+		t.Errorf("expected queued job to be cancelled, got %+v", job)
+	}
+	if repo, _ := datastore.FindRepositoryByName(db, "acme", "queued"); repo.Status != datastore.RepositoryFailed {
+		t.Errorf("expected repository of cancelled job to be failed, got %+v", repo)
+	}
+	if err := q.Cancel(job.ID); err != errImportFinished {
+		t.Errorf("expected cancelling a finished job to fail with %v, got %v", errImportFinished, err)
+	}
+
+	// running jobs are interrupted
+	importer = &stubImporter{started: make(chan string, 1), block: true}
+	q, db = newTestImportQueue(t, importer)
+	if err := q.Start(); err != nil {
+		t.Fatalf("failed to start queue: %v", err)
+	}
+	job = enqueueImport(t, q, "running")
+	select {
+	case <-importer.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the import to start")
+	}
+	if err := q.Cancel(job.ID); err != nil {
+		t.Fatalf("failed to cancel running job: %v", err)
+	}
+	if job = waitForJob(t, db, job.ID); job.State != datastore.ImportCancelled {
+		t.Errorf("expected running job to be cancelled, got %+v", job)
+	}
+	if repo, _ := datastore.FindRepositoryByName(db, "acme", "running"); repo.Status != datastore.RepositoryFailed {
+		t.Errorf("expected repository of cancelled job to be failed, got %+v", repo)
+	}
+}
+
+func TestImportQueueRequeue(t *testing.T) {
+	importer := &stubImporter{}
+	q, db := newTestImportQueue(t, importer)
+
+	// a job that was pushing when the server stopped
+	job := enqueueImport(t, q, "interrupted")
+	job.State = datastore.ImportPushing
+	if err := datastore.SaveImportJob(db, job); err != nil {
+		t.Fatalf("failed to save job: %v", err)
+	}
+
+	if err := q.Start(); err != nil {
+		t.Fatalf("failed to start queue: %v", err)
+	}
+	if job = waitForJob(t, db, job.ID); job.State != datastore.ImportDone {
+		t.Errorf("expected interrupted job to be run again, got %+v", job)
+	}
+	if tokens := importer.importedTokens(); len(tokens) != 1 {
+		t.Errorf("expected the job to be imported once, got %d imports", len(tokens))
+	}
+}
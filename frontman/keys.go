@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	gerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/google/go-github/github"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// githubKeyComment prefixes the comment of the SSH keys we copy from Github into gerrit. Only keys with this
+// comment are removed when they disappear from Github, keys added to gerrit by hand are left alone.
+const githubKeyComment = "github-key-"
+
+// keySyncer keeps the SSH keys of users gerrit accounts in line with their Github public keys
+type keySyncer struct {
+	db        *gorm.DB
+	githubCfg GithubConfig
+	gerritCfg GerritConfig
+}
+
+// newKeySyncer returns a keySyncer for the Github and gerrit servers in the configs
+func newKeySyncer(db *gorm.DB, githubCfg GithubConfig, gerritCfg GerritConfig) *keySyncer {
+	return &keySyncer{
+		db:        db,
+		githubCfg: githubCfg,
+		gerritCfg: gerritCfg,
+	}
+}
+
+// OnLogin is a LoginHook that syncs the SSH keys of the (linked) user, using their token. Failures are logged,
+// but do not prevent the login (the keys will be synced on the next login or reconciliation).
+func (s *keySyncer) OnLogin(ctx context.Context, tok *oauth2.Token, ident *Identity, user *datastore.User) error {
+	if ident.Provider != ProviderGithub || user.GerritAccountID == 0 || user.OffboardedAt != nil {
+		return nil // offboarded users (whose account could not be reactivated) must not get their keys back
+	}
+	tc := oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok.AccessToken}))
+	client, err := s.githubCfg.NewClient(tc)
+	if err != nil {
+		log.Println("Failed to setup github client for", user.Username, ":", err)
+		return nil
+	}
+	if err := s.Sync(client, "", user); err != nil {
+		log.Println("Failed to sync SSH keys for", user.Username, ":", err)
+	}
+	return nil
+}
+
+// Start reconciles the keys of all linked users every interval (in the background)
+func (s *keySyncer) Start(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.Reconcile(); err != nil {
+				log.Println("Failed to reconcile SSH keys:", err)
+			}
+		}
+	}()
+}
+
+// Reconcile syncs the SSH keys of all the linked (and not offboarded) Github users, using their public Github keys (read as
+// the service account, or without a token subject to the unauthenticated rate limits)
+func (s *keySyncer) Reconcile() error {
+	users, err := datastore.ListLinkedUsers(s.db)
+	if err != nil {
+		return errors.Wrap(err, "failed to list linked users")
+	}
+	client, err := s.githubCfg.NewServiceClient(context.Background())
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		user := &users[i]
+		if user.GithubID == 0 {
+			continue // not a Github user
+		}
+		if err := s.Sync(client, user.Username, user); err != nil {
+			log.Println("Failed to sync SSH keys for", user.Username, ":", err)
+		}
+	}
+	return nil
+}
+
+// Sync adds the Github keys of the user (the authenticated user if githubLogin is empty) that are missing from
+// their linked gerrit account, and removes the keys we added earlier that are no longer on Github.
+func (s *keySyncer) Sync(client *github.Client, githubLogin string, user *datastore.User) error {
+	wanted := map[string]int{} // normalized key -> github key ID
+	opt := github.ListOptions{PerPage: 100}
+	for {
+		keys, resp, err := client.Users.ListKeys(githubLogin, &opt)
+		if err != nil {
+			return errors.Wrap(err, "failed to list github keys")
+		}
+		for _, key := range keys {
+			if key.Key != nil && key.ID != nil {
+				wanted[normalizeSSHKey(*key.Key)] = *key.ID
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	gclt, err := s.gerritCfg.NewClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to setup client to gerrit server")
+	}
+	account := strconv.Itoa(user.GerritAccountID)
+	current, resp, err := gclt.Accounts.ListSSHKeys(account)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil // no gerrit account (anymore)
+	} else if err != nil {
+		return errors.Wrap(err, "failed to list gerrit SSH keys")
+	}
+
+	have := map[string]bool{}
+	for _, key := range *current {
+		normalized := normalizeSSHKey(key.SSHPublicKey)
+		have[normalized] = true
+		if _, ok := wanted[normalized]; ok || !strings.HasPrefix(key.Comment, githubKeyComment) {
+			continue
+		}
+		log.Println("Removing SSH key", key.Seq, "of", user.Username, "(no longer on Github)")
+		if _, err := gclt.Accounts.DeleteSSHKey(account, strconv.Itoa(key.Seq)); err != nil {
+			return errors.Wrapf(err, "failed to remove SSH key %d", key.Seq)
+		}
+	}
+	for key, id := range wanted {
+		if have[key] {
+			continue
+		}
+		log.Println("Adding Github SSH key", id, "to", user.Username)
+		if err := addSSHKey(gclt, account, key+" "+githubKeyComment+strconv.Itoa(id)); err != nil {
+			return errors.Wrapf(err, "failed to add Github SSH key %d", id)
+		}
+	}
+	return nil
+}
+
+// addSSHKey adds the (OpenSSH formatted) public key to the gerrit account. go-gerrit has no call for this,
+// gerrit wants the key as the raw (text/plain) request body.
+func addSSHKey(gclt *gerrit.Client, account, key string) error {
+	req, err := gclt.NewRequest("POST", "accounts/"+url.PathEscape(account)+"/sshkeys", nil)
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader(key))
+	req.ContentLength = int64(len(key))
+	req.Header.Set("Content-Type", "text/plain")
+	_, err = gclt.Do(req, nil)
+	return err
+}
+
+// normalizeSSHKey returns the algorithm and (encoded) key of the public key, without its comment
+func normalizeSSHKey(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return strings.TrimSpace(key)
+	}
+	return fields[0] + " " + fields[1]
+}
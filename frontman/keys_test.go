@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+)
+
+func TestNormalizeSSHKey(t *testing.T) {
+	tests := map[string]string{
+		"ssh-ed25519 AAAAC3Nza mona@laptop":  "ssh-ed25519 AAAAC3Nza",
+		"ssh-rsa AAAAB3Nza github-key-42\n":  "ssh-rsa AAAAB3Nza",
+		"  ssh-rsa   AAAAB3Nza  ":            "ssh-rsa AAAAB3Nza",
+		"ecdsa-sha2-nistp256 AAAAE2Vj a b c": "ecdsa-sha2-nistp256 AAAAE2Vj",
+	}
+	for in, want := range tests {
+		if got := normalizeSSHKey(in); got != want {
+			t.Errorf("normalizeSSHKey(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestKeySync(t *testing.T) {
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/users/octocat/keys" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 5, "key": "ssh-ed25519 AAAAnew"}})
+	}))
+	defer github.Close()
+	gerrit := newFakeGerrit()
+	srv := httptest.NewServer(gerrit)
+	defer srv.Close()
+	// the gerrit account (whose username differs from the Github login) has a key we added that is no longer
+	// on Github, and one added by hand
+	gerrit.keys["1000"] = []map[string]interface{}{
+		{"seq": 1, "ssh_public_key": "ssh-ed25519 AAAAold github-key-3", "comment": "github-key-3"},
+		{"seq": 2, "ssh_public_key": "ssh-ed25519 AAAAmine mona@laptop", "comment": "mona@laptop"},
+	}
+
+	s := newKeySyncer(nil, GithubConfig{URL: github.URL}, GerritConfig{Addr: srv.URL, Username: "admin", Password: "secret"})
+	client, err := s.githubCfg.NewClient(nil)
+	if err != nil {
+		t.Fatalf("failed to setup github client: %v", err)
+	}
+	user := datastore.User{Username: "mona", GithubID: 1, GerritAccountID: 1000}
+	if err := s.Sync(client, "octocat", &user); err != nil {
+		t.Fatalf("failed to sync keys: %v", err)
+	}
+
+	want := []string{"DELETE /accounts/1000/sshkeys/1", "POST /accounts/1000/sshkeys"}
+	if got := gerrit.changes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected changes %q, got %q", want, got)
+	}
+}
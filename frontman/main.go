@@ -1,27 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"goji.io/pat"
 
 	goji "goji.io"
 
 	"github.com/amoghe/polly/frontman/datastore"
-	"github.com/dghubble/sessions"
+	"github.com/google/go-github/github"
 	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var (
-	// sessionStore encodes and decodes session data stored in signed cookies
-	sessionStore = sessions.NewCookieStore([]byte("pollySecret"), nil)
-)
-
 // Server represents the server
 type Server struct {
 	db  *gorm.DB
@@ -31,18 +31,48 @@ type Server struct {
 // main creates and starts a Server listening.
 func main() {
 	var (
-		listenAddress = "0.0.0.0:8080"
-		// github
-		clientID     = flag.String("client-id", "", "Github Client ID")
-		clientSecret = flag.String("client-secret", "", "Github Client Secret")
+		listenAddress = flag.String("listen-addr", "0.0.0.0:8080", "Address to listen on")
+		baseURL       = flag.String("base-url", "http://localhost:8080", "Externally visible base URL of frontman")
+		// identity provider
+		provider     = flag.String("identity-provider", ProviderGithub, "Identity provider (github, gitlab or oidc)")
+		clientID     = flag.String("client-id", "", "OAuth2 Client ID (for the identity provider)")
+		clientSecret = flag.String("client-secret", "", "OAuth2 Client Secret (for the identity provider)")
+		gitlabURL    = flag.String("gitlab-url", "https://gitlab.com", "Gitlab instance URL")
+		gitlabGroup  = flag.String("gitlab-group", "", "Gitlab group (full path) users must be members of")
+		oidcIssuer   = flag.String("oidc-issuer-url", "", "OpenID Connect issuer URL")
+		oidcScopes   = flag.String("oidc-scopes", "openid,profile,email", "Comma separated OpenID Connect scopes")
+		oidcClaim    = flag.String("oidc-groups-claim", "groups", "OpenID Connect userinfo claim that lists groups")
+		oidcGroup    = flag.String("oidc-group", "", "OpenID Connect group users must be in")
 		// database
 		dbType  = flag.String("db-type", "sqlite3", "Type of database")
 		dbDSN   = flag.String("db-dsn", "/tmp/polly", "Database DSN")
 		orgName = flag.String("github-org-name", "", "Github org  name")
+		orgs    = flag.String("github-orgs", "", "Comma separated Github orgs (as org[:role]) whose members are allowed")
+		hookSec = flag.String("github-webhook-secret", "", "Secret that Github signs webhook events with (or set GITHUB_WEBHOOK_SECRET)")
+		dplTok  = flag.String("github-deploy-token", "", "Token used to replicate changes back to Github (or set GITHUB_DEPLOY_TOKEN, defaults to the service token)")
+		svcTok  = flag.String("github-service-token", "", "Token of the Github account background jobs act as (or set GITHUB_SERVICE_TOKEN)")
+		scopes  = flag.String("github-scopes", "read:public_key,read:org", "Comma separated Github scopes requested at login (and required of tokens)")
+		// github enterprise
+		githubURL    = flag.String("github-url", "", "Github Enterprise URL (leave empty for github.com)")
+		githubAPIURL = flag.String("github-api-url", "", "Github Enterprise API URL (defaults to <github-url>/api/v3/)")
 		// gerrit
 		gerritAddr      = flag.String("gerrit-addr", "localhost:10080", "Address of gerrit server")
 		gerritAdminUser = flag.String("gerrit-admin-user", "admin", "Admin user (gerrit)")
 		gerritAdminPass = flag.String("gerrit-admin-pass", "supersecret", "Admin pass (gerrit)")
+		teamGroups      = flag.String("team-groups", "", "Comma separated Github team to Gerrit group mappings (org/team=group)")
+		membersGroup    = flag.String("gerrit-members-group", defaultMembersGroup, "Gerrit group that provisioned (non guest) users are placed in")
+		keySyncInterval = flag.Duration("key-sync-interval", time.Hour, "How often SSH keys are reconciled with Github (0 disables)")
+		offboardEvery   = flag.Duration("offboard-interval", 0, "How often users who left the Github orgs are offboarded from Gerrit (0 disables)")
+		offboardDryRun  = flag.Bool("offboard-dry-run", false, "Only report (and audit) what offboarding would do")
+		eventsSecret    = flag.String("gerrit-events-secret", "", "Secret that the gerrit ref-updated hook signs events with (or set GERRIT_EVENTS_SECRET)")
+		importWorkers   = flag.Int("import-workers", defaultImportWorkers, "Number of repository imports run concurrently")
+		// sessions
+		sessionKeys     = flag.String("session-keys", "", "Comma separated session keys (first one signs, all verify)")
+		sessionKeysFile = flag.String("session-keys-file", "", "File containing session keys, one per line (first one signs)")
+		tokenLogin      = flag.Bool("token-login", false, "Allow login using a personal access token (opt-in)")
+		verifyTTL       = flag.Duration("verify-cache-ttl", 5*time.Minute, "How long to cache successful token verifications")
+		apiTokenMaxTTL  = flag.Duration("api-token-max-ttl", defaultAPITokenMaxTTL, "Longest time an API token may be valid for")
+		verifyNegTTL    = flag.Duration("verify-cache-negative-ttl", 30*time.Second, "How long to cache failed token verifications")
 		// cfg structs
 
 	)
@@ -50,7 +80,15 @@ func main() {
 	// allow consumer credential flags to override config fields
 	flag.Parse()
 
-	if len(*orgName) <= 0 {
+	githubOrgs, err := parseGithubOrgs(*orgName, *orgs)
+	if err != nil {
+		log.Fatal("Invalid Github orgs: ", err)
+	}
+	teamMappings, err := parseTeamMappings(*teamGroups)
+	if err != nil {
+		log.Fatal("Invalid team mappings: ", err)
+	}
+	if *provider == ProviderGithub && len(githubOrgs) <= 0 {
 		log.Fatal("Missing Github org name")
 	}
 
@@ -63,6 +101,11 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to migrate db: ", err)
 	}
+	for _, org := range githubOrgs {
+		if err := datastore.SaveOrganization(db, &datastore.Organization{Name: org.Name, Role: org.Role}); err != nil {
+			log.Fatal("Failed to save org: ", err)
+		}
+	}
 
 	firstNonZero := func(opts []string) string {
 		for _, s := range opts {
@@ -73,21 +116,104 @@ func main() {
 		log.Fatal("Missing param")
 		return ""
 	}
+	// firstNonEmpty is firstNonZero for optional params
+	firstNonEmpty := func(opts []string) string {
+		for _, s := range opts {
+			if s != "" {
+				return s
+			}
+		}
+		return ""
+	}
 
-	srv := NewServer(
-		GithubConfig{
-			OrgName:  firstNonZero([]string{*orgName}),
-			ClientID: firstNonZero([]string{*clientID, os.Getenv("GITHUB_CLIENT_ID")}),
-			Secret:   firstNonZero([]string{*clientSecret, os.Getenv("GITHUB_CLIENT_SECRET")}),
-		},
+	keys, err := loadSessionKeys(*sessionKeys, os.Getenv("FRONTMAN_SESSION_KEYS"), *sessionKeysFile)
+	if err != nil {
+		log.Fatal("Failed to load session keys: ", err)
+	}
+	if len(keys) <= 0 {
+		// sessions will not survive a restart, since the key is regenerated every time
+		log.Println("No session keys specified, generating a random one")
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("Failed to generate session key: ", err)
+		}
+		keys = append(keys, key)
+	}
+
+	githubCfg := GithubConfig{
+		Orgs:   githubOrgs,
+		URL:    *githubURL,
+		APIURL: *githubAPIURL,
+
+		ServiceToken:  firstNonEmpty([]string{*svcTok, os.Getenv("GITHUB_SERVICE_TOKEN")}),
+		DeployToken:   firstNonEmpty([]string{*dplTok, os.Getenv("GITHUB_DEPLOY_TOKEN")}),
+		WebhookSecret: firstNonEmpty([]string{*hookSec, os.Getenv("GITHUB_WEBHOOK_SECRET")}),
+	}
+	for _, scope := range splitScopes(*scopes) {
+		githubCfg.Scopes = append(githubCfg.Scopes, github.Scope(scope))
+	}
+	authCfg := AuthConfig{
+		Provider:               *provider,
+		BaseURL:                *baseURL,
+		SessionKeys:            keys,
+		AllowTokenLogin:        *tokenLogin,
+		VerifyCacheTTL:         *verifyTTL,
+		VerifyCacheNegativeTTL: *verifyNegTTL,
+		APITokenMaxTTL:         *apiTokenMaxTTL,
+	}
+	switch *provider {
+	case ProviderGithub:
+		githubCfg.ClientID = firstNonZero([]string{*clientID, os.Getenv("GITHUB_CLIENT_ID")})
+		githubCfg.Secret = firstNonZero([]string{*clientSecret, os.Getenv("GITHUB_CLIENT_SECRET")})
+	case ProviderGitlab:
+		authCfg.Gitlab = GitlabConfig{
+			URL:       firstNonZero([]string{*gitlabURL}),
+			GroupName: firstNonZero([]string{*gitlabGroup}),
+			ClientID:  firstNonZero([]string{*clientID, os.Getenv("GITLAB_CLIENT_ID")}),
+			Secret:    firstNonZero([]string{*clientSecret, os.Getenv("GITLAB_CLIENT_SECRET")}),
+		}
+	case ProviderOIDC:
+		authCfg.OIDC = OIDCConfig{
+			IssuerURL:     firstNonZero([]string{*oidcIssuer}),
+			ClientID:      firstNonZero([]string{*clientID, os.Getenv("OIDC_CLIENT_ID")}),
+			Secret:        firstNonZero([]string{*clientSecret, os.Getenv("OIDC_CLIENT_SECRET")}),
+			Scopes:        strings.Split(*oidcScopes, ","),
+			GroupsClaim:   *oidcClaim,
+			RequiredGroup: firstNonZero([]string{*oidcGroup}),
+		}
+	default:
+		log.Fatal("Unknown identity provider: ", *provider)
+	}
+
+	srv, err := NewServer(
+		githubCfg,
 		GerritConfig{
-			Addr:     firstNonZero([]string{*gerritAddr}),
-			Username: firstNonZero([]string{*gerritAdminUser}),
-			Password: firstNonZero([]string{*gerritAdminPass}),
+			Addr:             firstNonZero([]string{*gerritAddr}),
+			Username:         firstNonZero([]string{*gerritAdminUser}),
+			Password:         firstNonZero([]string{*gerritAdminPass}),
+			TeamGroups:       teamMappings,
+			ImportWorkers:    *importWorkers,
+			MembersGroup:     *membersGroup,
+			KeySyncInterval:  *keySyncInterval,
+			OffboardInterval: *offboardEvery,
+			OffboardDryRun:   *offboardDryRun,
+			EventsSecret:     firstNonEmpty([]string{*eventsSecret, os.Getenv("GERRIT_EVENTS_SECRET")}),
 		},
+		authCfg,
 		db)
-	log.Println("Starting Server listening on:", listenAddress)
-	err = http.ListenAndServe(listenAddress, srv)
+	if err != nil {
+		log.Fatal("Failed to create server: ", err)
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := datastore.DeleteExpiredSessions(db, time.Now()); err != nil {
+				log.Println("Failed to delete expired sessions:", err)
+			}
+		}
+	}()
+
+	log.Println("Starting Server listening on:", *listenAddress, "(base URL:", *baseURL+")")
+	err = http.ListenAndServe(*listenAddress, srv)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -95,23 +221,131 @@ func main() {
 	log.Println("Frontman exiting")
 }
 
+// parseGithubOrgs returns the allowed orgs, from the single org name and the comma separated list of org[:role]
+// entries (orgs without a role grant RoleMember).
+func parseGithubOrgs(orgName, orgList string) ([]GithubOrg, error) {
+	orgs := []GithubOrg{}
+	if orgName != "" {
+		orgs = append(orgs, GithubOrg{Name: orgName, Role: RoleMember})
+	}
+	for _, entry := range strings.Split(orgList, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		org := GithubOrg{Name: entry, Role: RoleMember}
+		if i := strings.Index(entry, ":"); i >= 0 {
+			org.Name, org.Role = entry[:i], entry[i+1:]
+		}
+		if org.Role != RoleMember && org.Role != RoleGuest && org.Role != RoleAdmin {
+			return nil, errors.Errorf("unknown role %q for org %s", org.Role, org.Name)
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, nil
+}
+
+// loadSessionKeys returns the session keys from the first of the given sources that specifies any (a comma
+// separated flag value, a comma separated env var value, or a file containing one key per line).
+func loadSessionKeys(flagVal, envVal, filePath string) ([][]byte, error) {
+	split := func(val string) [][]byte {
+		keys := [][]byte{}
+		for _, k := range strings.Split(val, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return keys
+	}
+
+	if keys := split(flagVal); len(keys) > 0 {
+		return keys, nil
+	}
+	if keys := split(envVal); len(keys) > 0 {
+		return keys, nil
+	}
+	if filePath == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := [][]byte{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if k := strings.TrimSpace(scanner.Text()); k != "" && !strings.HasPrefix(k, "#") {
+			keys = append(keys, []byte(k))
+		}
+	}
+	return keys, scanner.Err()
+}
+
 // NewServer returns a new ServeMux with app routes.
-func NewServer(githubCfg GithubConfig, gerritCfg GerritConfig, db *gorm.DB) *Server {
+func NewServer(githubCfg GithubConfig, gerritCfg GerritConfig, authCfg AuthConfig, db *gorm.DB) (*Server, error) {
+	var (
+		accounts = newAccountLinker(db, gerritCfg)
+		teams    = newTeamSyncer(githubCfg, gerritCfg)
+		keys     = newKeySyncer(db, githubCfg, gerritCfg)
+		offboard = newOffboarder(db, githubCfg, gerritCfg)
+		importer = newRepoImporter("")
+	)
+	authRouter, err := NewAuthRouter(db, githubCfg, authCfg, accounts.OnLogin, offboard.OnLogin, teams.OnLogin, keys.OnLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL, err := parseBaseURL(authCfg.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newCookieSealer(authCfg.SessionKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	var (
 		mux          = goji.NewMux()
-		authRouter   = NewAuthRouter(githubCfg)
-		githubRouter = NewGithubRouter(authRouter.AuthTokenFromRequest)
-		gerritRouter = NewGerritRouter(db, gerritCfg, authRouter.AuthTokenFromRequest)
+		authn        = newAuthenticator(authRouter, githubCfg, authCfg)
+		githubRouter = authn.Middleware(NewGithubRouter(db, githubCfg))
+		replicate    = newReplicator(db, githubCfg, gerritCfg, importer)
+		imports      = newImportQueue(db, gerritCfg, importer, replicate, sealer)
+		mirroring    = newMirror(db, githubCfg, gerritCfg, importer)
+		gerritRouter = authn.Middleware(NewGerritRouter(db, gerritCfg, imports, offboard, replicate))
 	)
 
-	mux.Handle(pat.New("/auth/*"), authRouter)     // Auth routes
-	mux.Handle(pat.New("/github/*"), githubRouter) // Github routes
+	if err := imports.Start(); err != nil {
+		return nil, err
+	}
+	replicate.Start()
+	mirroring.Start()
+	if (authCfg.Provider == ProviderGithub || authCfg.Provider == "") && gerritCfg.KeySyncInterval > 0 {
+		keys.Start(gerritCfg.KeySyncInterval)
+	}
+	if (authCfg.Provider == ProviderGithub || authCfg.Provider == "") && gerritCfg.OffboardInterval > 0 {
+		offboard.Start(gerritCfg.OffboardInterval, gerritCfg.OffboardDryRun)
+	}
+
+	mux.Use(newCSRFProtector(baseURL).Middleware)                                               // All non GET routes
+	mux.Handle(pat.Get(RouteWhoami), authn.Middleware(newWhoamiHandler(authRouter, gerritCfg))) // ahead of /auth/*
+	mux.Handle(pat.New("/auth/*"), authRouter)                                                  // Auth routes
+	if authCfg.Provider == ProviderGithub || authCfg.Provider == "" {
+		mux.Handle(pat.New("/github/*"), githubRouter) // Github routes (need a Github token)
+	}
 	mux.Handle(pat.New("/gerrit/*"), gerritRouter) // Gerrit routes
+	if gerritCfg.EventsSecret != "" {
+		mux.Handle(pat.Post(RouteGerritEvents), replicate) // Gerrit events (authenticated by their signature)
+	}
+	if githubCfg.WebhookSecret != "" {
+		mux.Handle(pat.Post(RouteGithubEvents), mirroring) // Github webhooks (authenticated by their signature)
+	}
 
 	return &Server{
 		mux: mux,
 		db:  db,
-	}
+	}, nil
 }
 
 // ServeHTTP allows Server to be a mux
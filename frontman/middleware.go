@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// errNotAuthenticated is returned when a handler asks for the identity of a request that was not
+// authenticated (i.e. the handler was not wrapped by the authentication middleware)
+var errNotAuthenticated = errors.New("request not authenticated")
+
+// identityKey is the (unexported, so collision free) context key under which the RequestIdentity is stored
+type identityKey struct{}
+
+// RequestIdentity is the authenticated caller of a request, as resolved by the authentication middleware
+type RequestIdentity struct {
+	// User is the datastore user the session (or API token) belongs to
+	User *datastore.User
+	// Memberships are the allowed orgs (and roles) that admitted the caller
+	Memberships []Membership
+	// Token is the callers upstream (identity provider) token
+	Token *oauth2.Token
+	// Github is a client acting as the caller (nil unless Github is the identity provider)
+	Github *github.Client
+	// ExpiresAt is when the session (or API token) expires (zero if it does not)
+	ExpiresAt time.Time
+}
+
+// Membership returns the callers membership of the given org (if they were admitted by it)
+func (id *RequestIdentity) Membership(org string) (Membership, bool) {
+	return findMembership(id.Memberships, org)
+}
+
+// authenticator is the middleware that resolves the caller of a request (once), rejecting unauthenticated
+// requests before they reach the handlers
+type authenticator struct {
+	auth      AuthenticatingRouter
+	githubCfg GithubConfig
+	useGithub bool
+}
+
+// newAuthenticator returns an authenticator that resolves callers using the auth router. Github clients are
+// only created for the callers if Github is the identity provider.
+func newAuthenticator(auth AuthenticatingRouter, githubCfg GithubConfig, authCfg AuthConfig) *authenticator {
+	return &authenticator{
+		auth:      auth,
+		githubCfg: githubCfg,
+		useGithub: authCfg.Provider == ProviderGithub || authCfg.Provider == "",
+	}
+}
+
+// Middleware wraps the handler so that it is only invoked for authenticated requests, whose identity can be
+// retrieved using IdentityFromRequest
+func (a *authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ident, err := a.auth.Authenticate(r)
+		if err == errMissingScopes {
+			a.handleReconsent(w, r)
+			return
+		} else if err != nil {
+			handleSessionExtractError(w, err)
+			return
+		}
+		if a.useGithub {
+			httpClient := oauth2.NewClient(r.Context(), oauth2.StaticTokenSource(ident.Token))
+			if ident.Github, err = a.githubCfg.NewClient(httpClient); err != nil {
+				handleInternalError(w, errors.Wrap(err, "couldn't create github client for current user"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, ident)))
+	})
+}
+
+// handleReconsent sends browser navigations through the login flow again (to grant the missing scopes),
+// returning to the requested page afterwards. Other (API) requests get a 401 pointing at the login URL.
+func (a *authenticator) handleReconsent(w http.ResponseWriter, r *http.Request) {
+	loginURL := a.auth.LoginURL(r.URL.RequestURI())
+	if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, loginURL, http.StatusFound)
+		return
+	}
+	log.Println(errMissingScopes)
+	gores.JSON(w, http.StatusUnauthorized, reconsentResponseBody{Error: errMissingScopes.Error(), LoginURL: loginURL})
+}
+
+// reconsentResponseBody tells API clients where to send the user to grant missing scopes
+type reconsentResponseBody struct {
+	Error    string `json:"error"`
+	LoginURL string `json:"login_url"`
+}
+
+// IdentityFromRequest returns the identity of the (authenticated) caller of the request
+func IdentityFromRequest(r *http.Request) (*RequestIdentity, error) {
+	ident, ok := r.Context().Value(identityKey{}).(*RequestIdentity)
+	if !ok || ident == nil {
+		return nil, errNotAuthenticated
+	}
+	return ident, nil
+}
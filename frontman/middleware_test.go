@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"golang.org/x/oauth2"
+)
+
+// fakeAuthRouter authenticates requests carrying a (any) cookie as the given identity
+type fakeAuthRouter struct {
+	AuthenticatingRouter
+	ident *RequestIdentity
+}
+
+func (f fakeAuthRouter) Authenticate(r *http.Request) (*RequestIdentity, error) {
+	if len(r.Cookies()) == 0 {
+		return nil, http.ErrNoCookie
+	}
+	return f.ident, nil
+}
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	ident := &RequestIdentity{
+		User:        &datastore.User{ID: 1, Username: "octocat"},
+		Memberships: []Membership{{Org: "polly", Role: RoleMember}},
+		Token:       &oauth2.Token{AccessToken: "tok"},
+	}
+	authn := newAuthenticator(fakeAuthRouter{ident: ident}, GithubConfig{}, AuthConfig{Provider: ProviderGithub})
+
+	var got *RequestIdentity
+	handler := authn.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if got, err = IdentityFromRequest(r); err != nil {
+			t.Errorf("failed to get identity from request: %v", err)
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/github/organizations", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated request to be rejected, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/github/organizations", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieMaker.Name, Value: "x"})
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got == nil || got.User.Username != "octocat" {
+		t.Fatalf("expected handler to see the callers identity, got %+v", got)
+	}
+	if got.Github == nil {
+		t.Errorf("expected a github client for the caller")
+	}
+	if _, ok := got.Membership("polly"); !ok {
+		t.Errorf("expected caller to be a member of polly")
+	}
+
+	if _, err := IdentityFromRequest(httptest.NewRequest("GET", "/", nil)); err != errNotAuthenticated {
+		t.Errorf("expected errNotAuthenticated, got %v", err)
+	}
+}
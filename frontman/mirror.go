@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// RouteGithubEvents receives (webhook) events from Github
+const RouteGithubEvents = "/hooks/github"
+
+// maxGithubEventSize is the largest webhook payload Github delivers
+const maxGithubEventSize = 25 << 20
+
+// mirror keeps the gerrit projects of imported repositories up to date with pushes that still land on Github
+// (e.g. hotfixes or bots), whenever Github reports them. Refs are only fast-forwarded, refs that diverged (or
+// tags that moved) are left alone and recorded on the repository instead.
+//
+// Replication (of gerrit back to Github) and mirroring trigger each other, but the second push of each round
+// trip is a no-op, so they settle.
+type mirror struct {
+	db        *gorm.DB
+	githubCfg GithubConfig
+	gerritCfg GerritConfig
+	importer  *repoImporter
+	wake      chan struct{}
+
+	mu      sync.Mutex
+	pending map[uint]bool // IDs of the repositories waiting to be mirrored
+}
+
+// githubPushEvent is the (relevant part of the) payload of the push events delivered by Github
+type githubPushEvent struct {
+	Ref        string `json:"ref"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		ID    int    `json:"id"`
+		Name  string `json:"name"`
+		Owner struct {
+			Login string `json:"login"`
+			Name  string `json:"name"` // set instead of the login in some payloads
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+// newMirror returns a mirror of Github into the gerrit server
+func newMirror(db *gorm.DB, githubCfg GithubConfig, gerritCfg GerritConfig, importer *repoImporter) *mirror {
+	return &mirror{
+		db:        db,
+		githubCfg: githubCfg,
+		gerritCfg: gerritCfg,
+		importer:  importer,
+		wake:      make(chan struct{}, 1),
+		pending:   map[uint]bool{},
+	}
+}
+
+// Start starts mirroring (in the background)
+func (m *mirror) Start() {
+	go func() {
+		for range m.wake {
+			for _, id := range m.takePending() {
+				m.sync(id)
+			}
+		}
+	}()
+}
+
+// Enqueue marks the repository as waiting to be mirrored. Repositories that are already waiting are only
+// mirrored once.
+func (m *mirror) Enqueue(repo *datastore.Repository) {
+	m.mu.Lock()
+	m.pending[repo.ID] = true
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takePending returns (and clears) the repositories waiting to be mirrored
+func (m *mirror) takePending() []uint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := []uint{}
+	for id := range m.pending {
+		ids = append(ids, id)
+	}
+	m.pending = map[uint]bool{}
+	return ids
+}
+
+// sync fast-forwards the branches and tags of the gerrit project to those of the Github repository,
+// recording the outcome (and the refs that diverged)
+func (m *mirror) sync(id uint) {
+	repo, err := datastore.FindRepositoryByID(m.db, id)
+	if err != nil {
+		log.Println("[MIRROR] Failed to lookup repository", id, ":", err)
+		return
+	}
+
+	// the deploy credential can read whatever it may push to
+	src := gitRemote{URL: repo.GithubCloneURL, Username: "x-access-token", Password: m.githubCfg.ReplicationToken()}
+	dst := gitRemote{URL: m.gerritCfg.GitURL(repo.GerritProject), Username: m.gerritCfg.Username, Password: m.gerritCfg.Password}
+	msg := ""
+	diverged, err := m.importer.Sync(context.Background(), src, dst)
+	if err != nil {
+		msg = err.Error()
+		log.Println("[MIRROR] Failed to mirror", repo.GerritProject, ":", err)
+	} else if len(diverged) > 0 {
+		log.Println("[MIRROR] Refs of", repo.GerritProject, "diverged from Github:", strings.Join(diverged, ", "))
+	}
+	if err := datastore.UpdateRepositoryMirror(m.db, repo.ID, diverged, msg, time.Now()); err != nil {
+		log.Println("[MIRROR] Failed to record mirroring of", repo.GerritProject, ":", err)
+	}
+}
+
+// ServeHTTP receives webhook events from Github. The webhook must be configured (on the repositories or their
+// org) to deliver push events to RouteGithubEvents as JSON, signed with the webhook secret. Pushes to imported
+// repositories are mirrored into gerrit, deleted refs are not.
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxGithubEventSize))
+	if err != nil {
+		handleJSONDecodeError(w, errors.Wrap(err, "failed to read event"))
+		return
+	}
+	if !validSignature(m.githubCfg.WebhookSecret, r.Header.Get("X-Hub-Signature-256"), body) {
+		handleUnauthorized(w, "invalid github webhook signature")
+		return
+	}
+	if r.Header.Get("X-GitHub-Event") != "push" {
+		w.WriteHeader(http.StatusNoContent) // e.g. the ping sent when the webhook is created
+		return
+	}
+
+	event := githubPushEvent{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		handleJSONDecodeError(w, err)
+		return
+	}
+	if event.Deleted || !(strings.HasPrefix(event.Ref, "refs/heads/") || strings.HasPrefix(event.Ref, "refs/tags/")) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	repo, err := datastore.FindRepositoryByGithubID(m.db, event.Repository.ID)
+	if err == gorm.ErrRecordNotFound {
+		owner := event.Repository.Owner.Login
+		if owner == "" {
+			owner = event.Repository.Owner.Name
+		}
+		repo, err = datastore.FindRepositoryByName(m.db, owner, event.Repository.Name)
+	}
+	if err == gorm.ErrRecordNotFound || (err == nil && repo.Status != datastore.RepositoryImported) {
+		w.WriteHeader(http.StatusNoContent) // not (yet) ours to mirror
+		return
+	} else if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to lookup repository"))
+		return
+	}
+	m.Enqueue(repo)
+	gores.JSON(w, http.StatusAccepted, repo)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+)
+
+func TestMirrorEvents(t *testing.T) {
+	m := newMirror(nil, GithubConfig{WebhookSecret: "s3cret"}, GerritConfig{}, nil)
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	push := `{"ref":"refs/heads/master","repository":{"id":7,"name":"widgets","owner":{"login":"acme"}}}`
+	for _, tc := range []struct {
+		event     string
+		body      string
+		signature string
+		status    int
+	}{
+		{"push", push, "", http.StatusUnauthorized},
+		{"push", push, sign("wrong", push), http.StatusUnauthorized},
+		{"push", push, "sha256=nothex", http.StatusUnauthorized},
+		{"ping", `{"zen":"Keep it logically awesome."}`, sign("s3cret", `{"zen":"Keep it logically awesome."}`), http.StatusNoContent},
+		{"push", `{"ref":"refs/heads/gone","deleted":true}`, sign("s3cret", `{"ref":"refs/heads/gone","deleted":true}`), http.StatusNoContent},
+		{"push", `{"ref":"refs/pull/1/head"}`, sign("s3cret", `{"ref":"refs/pull/1/head"}`), http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodPost, RouteGithubEvents, strings.NewReader(tc.body))
+		req.Header.Set("X-GitHub-Event", tc.event)
+		req.Header.Set("X-Hub-Signature-256", tc.signature)
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.event, tc.body, tc.status, rec.Code)
+		}
+	}
+
+	if validSignature("", sign("", push), []byte(push)) {
+		t.Errorf("events should be rejected when no secret is configured")
+	}
+}
+
+func TestMirrorSkipsLegacyRepositories(t *testing.T) {
+	db := newTestDB(t)
+	for _, repo := range []datastore.Repository{
+		{OrganizationID: "acme", Name: "widgets", GithubID: 7, GerritProject: "acme/widgets",
+			GithubCloneURL: "https://github.com/acme/widgets.git", Status: datastore.RepositoryImported},
+		{OrganizationID: "acme", Name: "gadgets", GithubID: 8, GerritProject: "gadgets", Status: datastore.RepositoryLegacy},
+	} {
+		if err := datastore.InsertRepository(db, &repo); err != nil {
+			t.Fatalf("failed to insert repository: %v", err)
+		}
+	}
+	m := newMirror(db, GithubConfig{WebhookSecret: "s3cret"}, GerritConfig{}, nil)
+
+	for name, status := range map[string]int{"widgets": http.StatusAccepted, "gadgets": http.StatusNoContent} {
+		body := `{"ref":"refs/heads/master","repository":{"name":"` + name + `","owner":{"login":"acme"}}}`
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(body))
+		req := httptest.NewRequest(http.MethodPost, RouteGithubEvents, strings.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", name, status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/google/go-github/github"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// offboardingActor is the actor recorded in the audit trail for offboarding (and reactivation) actions
+	offboardingActor = "offboarding"
+	// maxOffboardedShare is the largest share of the linked users that a single reconcile offboards (beyond a
+	// single user), anything more most likely means the member list is incomplete
+	maxOffboardedShare = 0.5
+)
+
+// errNoServiceToken is returned when offboarding without a service token, which is needed to see all the
+// (including concealed) members of the orgs
+var errNoServiceToken = errors.New("offboarding requires a Github service token")
+
+// OffboardingReport lists the users that left the allowed orgs, and what was (or would be) done about them
+type OffboardingReport struct {
+	DryRun  bool                `json:"dry_run"`
+	Members int                 `json:"members"` // active members across the allowed orgs
+	Users   []OffboardedAccount `json:"users"`
+}
+
+// OffboardedAccount is a user that left the allowed orgs, with the actions taken on their gerrit account
+type OffboardedAccount struct {
+	Username string   `json:"username"`
+	Actions  []string `json:"actions"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// offboarder deactivates the gerrit accounts of users who are no longer active members of (any of) the allowed
+// orgs, removing their group memberships, SSH keys and HTTP password (as well as their frontman sessions and
+// API tokens). Every action is recorded in the audit trail.
+type offboarder struct {
+	db        *gorm.DB
+	githubCfg GithubConfig
+	gerritCfg GerritConfig
+}
+
+// newOffboarder returns an offboarder for the orgs and gerrit server in the configs
+func newOffboarder(db *gorm.DB, githubCfg GithubConfig, gerritCfg GerritConfig) *offboarder {
+	return &offboarder{
+		db:        db,
+		githubCfg: githubCfg,
+		gerritCfg: gerritCfg,
+	}
+}
+
+// Start reconciles every interval (in the background). It does nothing without a service token.
+func (o *offboarder) Start(interval time.Duration, dryRun bool) {
+	if o.githubCfg.ServiceToken == "" {
+		log.Println("Not offboarding users:", errNoServiceToken)
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := o.Reconcile(context.Background(), dryRun); err != nil {
+				log.Println("Failed to reconcile offboarded users:", err)
+			}
+		}
+	}()
+}
+
+// Reconcile offboards the linked (Github) users that are not active members of any of the allowed orgs. In dry runs
+// the report (and audit trail) lists what would be done, without changing anything. It refuses to offboard
+// (a large share of) everyone, since that most likely means the member list is incomplete.
+func (o *offboarder) Reconcile(ctx context.Context, dryRun bool) (*OffboardingReport, error) {
+	if o.githubCfg.ServiceToken == "" {
+		return nil, errNoServiceToken
+	}
+	members, err := o.listMembers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) <= 0 {
+		// most likely the service account can't see the members, don't offboard everyone
+		return nil, errors.New("no active members found in the allowed orgs, refusing to offboard")
+	}
+
+	users, err := datastore.ListLinkedUsers(o.db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list linked users")
+	}
+
+	active, leavers := 0, []*datastore.User{}
+	for i := range users {
+		user := &users[i]
+		if user.GithubID == 0 {
+			continue // not a Github user, the orgs don't decide about them
+		}
+		active++
+		if !members[user.GithubID] { // logins can be renamed, IDs stay
+			leavers = append(leavers, user)
+		}
+	}
+	if len(leavers) > 1 && float64(len(leavers)) > maxOffboardedShare*float64(active) {
+		return nil, errors.Errorf("%d of the %d linked users are not members of the allowed orgs, refusing to offboard",
+			len(leavers), active)
+	}
+
+	report := OffboardingReport{DryRun: dryRun, Members: len(members), Users: []OffboardedAccount{}}
+	for _, user := range leavers {
+		report.Users = append(report.Users, o.offboard(user, dryRun))
+	}
+	return &report, nil
+}
+
+// offboard deactivates the gerrit account of the user (unless this is a dry run)
+func (o *offboarder) offboard(user *datastore.User, dryRun bool) OffboardedAccount {
+	acct := OffboardedAccount{Username: user.Username, Actions: []string{}}
+	fail := func(err error) OffboardedAccount {
+		acct.Error = err.Error()
+		o.audit("offboard", user.Username, "", dryRun, err)
+		log.Println("Failed to offboard", user.Username, ":", err)
+		return acct
+	}
+
+	gclt, err := o.gerritCfg.NewClient()
+	if err != nil {
+		return fail(errors.Wrap(err, "failed to setup client to gerrit server"))
+	}
+	account := strconv.Itoa(user.GerritAccountID)
+	groups, _, err := gclt.Accounts.ListGroups(account)
+	if err != nil {
+		return fail(errors.Wrap(err, "failed to list gerrit groups"))
+	}
+	keys, _, err := gclt.Accounts.ListSSHKeys(account)
+	if err != nil {
+		return fail(errors.Wrap(err, "failed to list gerrit SSH keys"))
+	}
+
+	// each step is recorded (and, unless this is a dry run, taken) in turn, stopping at the first failure
+	step := func(action, detail string, fn func() error) bool {
+		acct.Actions = append(acct.Actions, strings.TrimSpace(action+" "+detail))
+		var err error
+		if !dryRun {
+			err = fn()
+		}
+		o.audit(action, user.Username, detail, dryRun, err)
+		if err != nil {
+			acct.Error = err.Error()
+			log.Println("Failed to", action, detail, "of", user.Username, ":", err)
+		}
+		return err == nil
+	}
+
+	for _, group := range *groups {
+		group := group
+		if strings.HasPrefix(group.ID, "global:") {
+			continue // system groups (e.g. Registered Users) have implicit members
+		}
+		if !step("remove-group-member", group.Name, func() error {
+			_, err := gclt.Groups.DeleteGroupMember(group.ID, account)
+			return err
+		}) {
+			return acct
+		}
+	}
+	for _, key := range *keys {
+		seq := strconv.Itoa(key.Seq)
+		if !step("delete-ssh-key", seq, func() error {
+			_, err := gclt.Accounts.DeleteSSHKey(account, seq)
+			return err
+		}) {
+			return acct
+		}
+	}
+	if !step("delete-http-password", "", func() error {
+		_, err := gclt.Accounts.DeleteHTTPPassword(account)
+		return err
+	}) {
+		return acct
+	}
+	if !step("deactivate-account", "", func() error {
+		_, err := gclt.Accounts.DeleteActive(account)
+		return err
+	}) {
+		return acct
+	}
+	if !step("delete-sessions", "", func() error {
+		return datastore.DeleteSessionsForUser(o.db, user.ID)
+	}) {
+		return acct
+	}
+	if !step("delete-api-tokens", "", func() error {
+		return datastore.DeleteAPITokensForUser(o.db, user.ID)
+	}) {
+		return acct
+	}
+
+	if !dryRun {
+		now := time.Now()
+		if err := datastore.SetUserOffboarded(o.db, user.ID, &now); err != nil {
+			return fail(errors.Wrap(err, "failed to record offboarding"))
+		}
+		log.Println("Offboarded", user.Username)
+	}
+	return acct
+}
+
+// OnLogin is a LoginHook that reactivates the gerrit account of offboarded users (who must have rejoined an
+// allowed org, since they were admitted). Failures are logged, but do not prevent the login.
+func (o *offboarder) OnLogin(ctx context.Context, tok *oauth2.Token, ident *Identity, user *datastore.User) error {
+	if user.OffboardedAt == nil || user.GerritAccountID == 0 {
+		return nil
+	}
+	if err := o.Reactivate(user); err != nil {
+		log.Println("Failed to reactivate", user.Username, ":", err)
+	}
+	return nil
+}
+
+// Reactivate reactivates the (offboarded) gerrit account of a user who logged in again (i.e. rejoined an
+// allowed org). Their groups and SSH keys are restored by the team and key syncers.
+func (o *offboarder) Reactivate(user *datastore.User) error {
+	gclt, err := o.gerritCfg.NewClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to setup client to gerrit server")
+	}
+	_, err = gclt.Accounts.SetActive(strconv.Itoa(user.GerritAccountID))
+	o.audit("reactivate-account", user.Username, "", false, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to reactivate gerrit account")
+	}
+	user.OffboardedAt = nil
+	return datastore.SetUserOffboarded(o.db, user.ID, nil)
+}
+
+// listMembers returns the (Github user) IDs of the active members of all the allowed orgs
+func (o *offboarder) listMembers(ctx context.Context) (map[int]bool, error) {
+	client, err := o.githubCfg.NewServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members := map[int]bool{}
+	for _, org := range o.githubCfg.Orgs {
+		opt := github.ListMembersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+		for {
+			page, resp, err := client.Organizations.ListMembers(org.Name, &opt)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to list members of %s", org.Name)
+			}
+			for _, member := range page {
+				if member.ID != nil {
+					members[*member.ID] = true
+				}
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opt.Page = resp.NextPage
+		}
+	}
+	return members, nil
+}
+
+// audit records the action in the audit trail
+func (o *offboarder) audit(action, subject, detail string, dryRun bool, err error) {
+	event := datastore.AuditEvent{
+		Actor:   offboardingActor,
+		Action:  action,
+		Subject: subject,
+		Detail:  detail,
+		DryRun:  dryRun,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if err := datastore.InsertAuditEvent(o.db, &event); err != nil {
+		log.Println("Failed to record audit event", action, "for", subject, ":", err)
+	}
+}
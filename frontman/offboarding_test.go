@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/jinzhu/gorm"
+)
+
+var testDBs = 0
+
+// newTestDB returns a fresh (migrated) in-memory database
+func newTestDB(t *testing.T) *gorm.DB {
+	testDBs++
+	db, err := datastore.OpenDatabase("sqlite3", fmt.Sprintf("file:frontman-test-%d?mode=memory&cache=shared", testDBs))
+	if err != nil {
+		t.Fatalf("failed to create in-memory db: %v", err)
+	}
+	if err := datastore.MigrateDatabase(db); err != nil {
+		t.Fatalf("failed to migrate db: %v", err)
+	}
+	return db
+}
+
+// fakeGerrit fakes the (account and group) REST endpoints of a gerrit server. It insists on (any) digest auth,
+// so that the unauthenticated probes go-gerrit makes never reach the handlers.
+type fakeGerrit struct {
+	mu       sync.Mutex
+	accounts map[string]map[string]interface{}   // username -> account
+	groups   map[string][]map[string]interface{} // username -> groups
+	keys     map[string][]map[string]interface{} // username -> SSH keys
+	fail     map[string]bool                     // "METHOD path" -> respond with an error
+	requests []string                            // the changes made, as "METHOD path"
+}
+
+func newFakeGerrit() *fakeGerrit {
+	return &fakeGerrit{
+		accounts: map[string]map[string]interface{}{},
+		groups:   map[string][]map[string]interface{}{},
+		keys:     map[string][]map[string]interface{}{},
+		fail:     map[string]bool{},
+	}
+}
+
+func (f *fakeGerrit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Digest ") {
+		w.Header().Set("WWW-Authenticate", `Digest realm="Gerrit Code Review", nonce="abc", qop="auth"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/a")
+	req := r.Method + " " + path
+	if f.fail[req] {
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "accounts" {
+		if acct, ok := f.accounts[parts[1]]; ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(acct)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "accounts" {
+		w.Header().Set("Content-Type", "application/json")
+		switch parts[2] {
+		case "groups":
+			json.NewEncoder(w).Encode(append([]map[string]interface{}{}, f.groups[parts[1]]...))
+			return
+		case "sshkeys":
+			json.NewEncoder(w).Encode(append([]map[string]interface{}{}, f.keys[parts[1]]...))
+			return
+		}
+	}
+	f.requests = append(f.requests, req)
+	if r.Method == http.MethodPut && (len(parts) == 2 && parts[0] == "accounts" || len(parts) == 4 && parts[2] == "members") {
+		// account creations and group additions respond with the account
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"_account_id": 2000, "username": parts[len(parts)-1]})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGerrit) changes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+// newFakeGithubOrg returns a server that fakes the members endpoint of the acme org on a Github Enterprise
+// instance, whose members have the given IDs (and logins that differ from their frontman usernames)
+func newFakeGithubOrg(members ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/orgs/acme/members" || r.Header.Get("Authorization") != "Bearer svc-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		page := []map[string]interface{}{}
+		for _, id := range members {
+			page = append(page, map[string]interface{}{"id": id, "login": fmt.Sprintf("renamed-%d", id)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+}
+
+func TestOffboarding(t *testing.T) {
+	leaverChanges := []string{
+		"DELETE /groups/team-members-uuid/members/1001",
+		"DELETE /accounts/1001/sshkeys/1",
+		"DELETE /accounts/1001/password.http",
+		"DELETE /accounts/1001/active",
+	}
+	leaverActions := []string{
+		"remove-group-member team-members",
+		"delete-ssh-key 1",
+		"delete-http-password",
+		"deactivate-account",
+		"delete-sessions",
+		"delete-api-tokens",
+	}
+
+	tests := []struct {
+		name        string
+		dryRun      bool
+		fail        string   // request that fails
+		wantChanges []string // requests that reach gerrit
+		wantActions []string
+		offboarded  bool
+	}{
+		{
+			name:        "dry run",
+			dryRun:      true,
+			wantChanges: []string{},
+			wantActions: leaverActions,
+		},
+		{
+			name:        "offboard",
+			wantChanges: leaverChanges,
+			wantActions: leaverActions,
+			offboarded:  true,
+		},
+		{
+			name:        "failed step",
+			fail:        "DELETE /accounts/1001/password.http",
+			wantChanges: leaverChanges[:2],
+			wantActions: leaverActions[:3],
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			github := newFakeGithubOrg(1, 3)
+			defer github.Close()
+			gerrit := newFakeGerrit()
+			srv := httptest.NewServer(gerrit)
+			defer srv.Close()
+
+			gerrit.groups["1001"] = []map[string]interface{}{
+				{"id": "global:Registered-Users", "name": "Registered Users"},
+				{"id": "team-members-uuid", "name": "team-members"},
+			}
+			gerrit.keys["1001"] = []map[string]interface{}{{"seq": 1, "ssh_public_key": "ssh-ed25519 AAAA"}}
+			if tc.fail != "" {
+				gerrit.fail[tc.fail] = true
+			}
+
+			users := map[string]*datastore.User{}
+			for i, name := range []string{"stays", "leaver", "other"} {
+				user := &datastore.User{Username: name, GithubID: i + 1, GerritAccountID: 1000 + i}
+				if err := datastore.InsertUser(db, user); err != nil {
+					t.Fatalf("failed to insert user: %v", err)
+				}
+				users[name] = user
+			}
+			// users of other providers are not offboarded by the Github orgs
+			gitlabUser := datastore.User{Provider: ProviderGitlab, Subject: "9", Username: "gitlab-user", GerritAccountID: 1009}
+			if err := datastore.InsertUser(db, &gitlabUser); err != nil {
+				t.Fatalf("failed to insert user: %v", err)
+			}
+			now := time.Now()
+			session := datastore.Session{ID: "leaver-session", UserID: users["leaver"].ID, ExpiresAt: now.Add(time.Hour)}
+			if err := datastore.InsertSession(db, &session); err != nil {
+				t.Fatalf("failed to insert session: %v", err)
+			}
+			token := datastore.APIToken{UserID: users["leaver"].ID, Hash: "leaver-token"}
+			if err := datastore.InsertAPIToken(db, &token); err != nil {
+				t.Fatalf("failed to insert API token: %v", err)
+			}
+
+			o := newOffboarder(db,
+				GithubConfig{Orgs: []GithubOrg{{Name: "acme"}}, URL: github.URL, ServiceToken: "svc-token"},
+				GerritConfig{Addr: srv.URL, Username: "admin", Password: "secret"})
+			report, err := o.Reconcile(context.Background(), tc.dryRun)
+			if err != nil {
+				t.Fatalf("failed to reconcile: %v", err)
+			}
+
+			if report.DryRun != tc.dryRun || report.Members != 2 || len(report.Users) != 1 {
+				t.Fatalf("expected (only) the leaver to be reported, got %+v", report)
+			}
+			acct := report.Users[0]
+			if acct.Username != "leaver" || !reflect.DeepEqual(acct.Actions, tc.wantActions) {
+				t.Errorf("expected actions %q, got %q", tc.wantActions, acct.Actions)
+			}
+			if (tc.fail != "") != (acct.Error != "") {
+				t.Errorf("unexpected error reported: %q", acct.Error)
+			}
+			if got := gerrit.changes(); !reflect.DeepEqual(got, tc.wantChanges) {
+				t.Errorf("expected changes %q, got %q", tc.wantChanges, got)
+			}
+
+			// every action is audited (the failed one with its error), most recent first
+			events, err := datastore.ListAuditEvents(db, 100)
+			if err != nil || len(events) != len(tc.wantActions) {
+				t.Fatalf("expected %d audit events, got %d (%v)", len(tc.wantActions), len(events), err)
+			}
+			for i, event := range events {
+				if event.Subject != "leaver" || event.DryRun != tc.dryRun || event.Actor != offboardingActor {
+					t.Errorf("unexpected audit event: %+v", event)
+				}
+				if failed := i == 0 && tc.fail != ""; failed != (event.Error != "") {
+					t.Errorf("unexpected error in audit event: %+v", event)
+				}
+			}
+
+			user, _ := datastore.FindUserByID(db, users["leaver"].ID)
+			if (user.OffboardedAt != nil) != tc.offboarded {
+				t.Errorf("expected leaver offboarded to be %v, got %v", tc.offboarded, user.OffboardedAt)
+			}
+			_, sessionErr := datastore.FindActiveSession(db, session.ID, now)
+			_, tokenErr := datastore.FindActiveAPIToken(db, token.Hash, now)
+			if (sessionErr == gorm.ErrRecordNotFound) != tc.offboarded || (tokenErr == gorm.ErrRecordNotFound) != tc.offboarded {
+				t.Errorf("expected sessions and tokens deleted to be %v, got %v and %v", tc.offboarded, sessionErr, tokenErr)
+			}
+		})
+	}
+}
+
+func TestOffboardingRefusals(t *testing.T) {
+	db := newTestDB(t)
+	for i, name := range []string{"stays", "leaver", "another-leaver"} {
+		if err := datastore.InsertUser(db, &datastore.User{Username: name, GithubID: i + 1, GerritAccountID: 1000 + i}); err != nil {
+			t.Fatalf("failed to insert user: %v", err)
+		}
+	}
+	gerrit := newFakeGerrit()
+	srv := httptest.NewServer(gerrit)
+	defer srv.Close()
+	gerritCfg := GerritConfig{Addr: srv.URL, Username: "admin", Password: "secret"}
+
+	github := newFakeGithubOrg(1)
+	defer github.Close()
+	empty := newFakeGithubOrg()
+	defer empty.Close()
+
+	tests := map[string]GithubConfig{
+		"no service token":       {Orgs: []GithubOrg{{Name: "acme"}}, URL: github.URL},
+		"no members":             {Orgs: []GithubOrg{{Name: "acme"}}, URL: empty.URL, ServiceToken: "svc-token"},
+		"most users would leave": {Orgs: []GithubOrg{{Name: "acme"}}, URL: github.URL, ServiceToken: "svc-token"},
+	}
+	for name, githubCfg := range tests {
+		if _, err := newOffboarder(db, githubCfg, gerritCfg).Reconcile(context.Background(), false); err == nil {
+			t.Errorf("%s: expected reconcile to refuse", name)
+		}
+	}
+	if changes := gerrit.changes(); len(changes) != 0 {
+		t.Errorf("expected no changes, got %q", changes)
+	}
+}
+
+func TestOffboardingReactivate(t *testing.T) {
+	db := newTestDB(t)
+	gerrit := newFakeGerrit()
+	srv := httptest.NewServer(gerrit)
+	defer srv.Close()
+
+	now := time.Now()
+	user := datastore.User{Username: "rejoined", GithubID: 1, GerritAccountID: 1000, OffboardedAt: &now}
+	if err := datastore.InsertUser(db, &user); err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+
+	o := newOffboarder(db, GithubConfig{}, GerritConfig{Addr: srv.URL, Username: "admin", Password: "secret"})
+	if err := o.OnLogin(context.Background(), nil, &Identity{}, &user); err != nil {
+		t.Fatalf("login hook failed: %v", err)
+	}
+	if want := []string{"PUT /accounts/1000/active"}; !reflect.DeepEqual(gerrit.changes(), want) {
+		t.Errorf("expected changes %q, got %q", want, gerrit.changes())
+	}
+	if found, _ := datastore.FindUserByID(db, user.ID); found.OffboardedAt != nil {
+		t.Errorf("expected user to be reactivated, got %+v", found)
+	}
+	events, err := datastore.ListAuditEvents(db, 100)
+	if err != nil || len(events) != 1 || events[0].Action != "reactivate-account" || events[0].Error != "" {
+		t.Errorf("expected the reactivation to be audited, got %+v (%v)", events, err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RouteGerritEvents receives events from gerrit (the ref-updated hook shipped in the polly container)
+	RouteGerritEvents = "/hooks/gerrit"
+	// maxGerritEventSize is the largest event accepted from gerrit
+	maxGerritEventSize = 1 << 20
+)
+
+// replicator pushes the branches and tags of imported repositories from gerrit back to Github (using the
+// deploy credential), whenever gerrit reports that they changed. Pushes are never forced, refs that diverged
+// on Github fail the replication (which is recorded on the repository).
+type replicator struct {
+	db        *gorm.DB
+	githubCfg GithubConfig
+	gerritCfg GerritConfig
+	importer  *repoImporter
+	wake      chan struct{}
+
+	mu      sync.Mutex
+	pending map[uint]bool // IDs of the repositories waiting to be replicated
+}
+
+// gerritEvent is the (relevant part of the) JSON body of the events posted by gerrit, in the format of the
+// gerrit webhooks plugin
+type gerritEvent struct {
+	Type      string `json:"type"`
+	RefUpdate *struct {
+		Project string `json:"project"`
+		RefName string `json:"refName"`
+	} `json:"refUpdate"`
+	Change *struct {
+		Project string `json:"project"`
+	} `json:"change"`
+}
+
+// newReplicator returns a replicator from the gerrit server to Github
+func newReplicator(db *gorm.DB, githubCfg GithubConfig, gerritCfg GerritConfig, importer *repoImporter) *replicator {
+	return &replicator{
+		db:        db,
+		githubCfg: githubCfg,
+		gerritCfg: gerritCfg,
+		importer:  importer,
+		wake:      make(chan struct{}, 1),
+		pending:   map[uint]bool{},
+	}
+}
+
+// Start starts replicating (in the background)
+func (rp *replicator) Start() {
+	go func() {
+		for range rp.wake {
+			for _, id := range rp.takePending() {
+				rp.replicate(id)
+			}
+		}
+	}()
+}
+
+// Enqueue marks the repository as waiting to be replicated. Repositories that are already waiting are only
+// replicated once.
+func (rp *replicator) Enqueue(repo *datastore.Repository) error {
+	if repo.Status != datastore.RepositoryImported {
+		return errors.Errorf("%s/%s has not been imported", repo.OrganizationID, repo.Name)
+	}
+	if err := datastore.UpdateRepositoryReplication(rp.db, repo.ID, datastore.ReplicationPending, "", time.Now()); err != nil {
+		return err
+	}
+	rp.mu.Lock()
+	rp.pending[repo.ID] = true
+	rp.mu.Unlock()
+	select {
+	case rp.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// takePending returns (and clears) the repositories waiting to be replicated
+func (rp *replicator) takePending() []uint {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	ids := []uint{}
+	for id := range rp.pending {
+		ids = append(ids, id)
+	}
+	rp.pending = map[uint]bool{}
+	return ids
+}
+
+// replicate pushes the branches and tags of the repository from gerrit to Github, recording the outcome
+func (rp *replicator) replicate(id uint) {
+	repo, err := datastore.FindRepositoryByID(rp.db, id)
+	if err != nil {
+		log.Println("[REPLICATION] Failed to lookup repository", id, ":", err)
+		return
+	}
+
+	src := gitRemote{URL: rp.gerritCfg.GitURL(repo.GerritProject), Username: rp.gerritCfg.Username, Password: rp.gerritCfg.Password}
+	dst := gitRemote{URL: repo.GithubCloneURL, Username: "x-access-token", Password: rp.githubCfg.ReplicationToken()}
+	status, msg := datastore.ReplicationOK, ""
+	if err := rp.importer.Import(context.Background(), src, dst, nil); err != nil {
+		status, msg = datastore.ReplicationFailed, err.Error()
+		log.Println("[REPLICATION] Failed to replicate", repo.GerritProject, ":", err)
+	} else {
+		log.Println("[REPLICATION] Replicated", repo.GerritProject, "to Github")
+	}
+	if err := datastore.UpdateRepositoryReplication(rp.db, repo.ID, status, msg, time.Now()); err != nil {
+		log.Println("[REPLICATION] Failed to record replication of", repo.GerritProject, ":", err)
+	}
+}
+
+// ServeHTTP receives events from gerrit. The events are posted to RouteGerritEvents, signed with the events
+// secret (the X-Gerrit-Signature-256 header, computed like Github's X-Hub-Signature-256). Branch and tag updates
+// (including submitted changes) of imported projects are replicated.
+func (rp *replicator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxGerritEventSize))
+	if err != nil {
+		handleJSONDecodeError(w, errors.Wrap(err, "failed to read event"))
+		return
+	}
+	if !validSignature(rp.gerritCfg.EventsSecret, r.Header.Get("X-Gerrit-Signature-256"), body) {
+		handleUnauthorized(w, "invalid gerrit event signature")
+		return
+	}
+
+	event := gerritEvent{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		handleJSONDecodeError(w, err)
+		return
+	}
+	project := ""
+	switch {
+	case event.Type == "ref-updated" && event.RefUpdate != nil:
+		if !strings.HasPrefix(event.RefUpdate.RefName, "refs/heads/") && !strings.HasPrefix(event.RefUpdate.RefName, "refs/tags/") {
+			break // e.g. refs/changes or refs/meta/config
+		}
+		project = event.RefUpdate.Project
+	case event.Type == "change-merged" && event.Change != nil:
+		project = event.Change.Project
+	}
+	if project == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	repo, err := datastore.FindRepositoryByProject(rp.db, project)
+	if err == gorm.ErrRecordNotFound || (err == nil && repo.Status != datastore.RepositoryImported) {
+		w.WriteHeader(http.StatusNoContent) // not (yet) ours to replicate
+		return
+	} else if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to lookup repository"))
+		return
+	}
+	if err := rp.Enqueue(repo); err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to queue replication"))
+		return
+	}
+	gores.JSON(w, http.StatusAccepted, repo)
+}
+
+// validSignature returns whether the signature (as "sha256=" followed by the hex encoded MAC) is the
+// HMAC-SHA256 of the body, keyed with the secret. Nothing is valid without a secret.
+func validSignature(secret, signature string, body []byte) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
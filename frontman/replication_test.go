@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+)
+
+func TestReplicatorEvents(t *testing.T) {
+	rp := newReplicator(nil, GithubConfig{}, GerritConfig{EventsSecret: "s3cret"}, nil)
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	merged := `{"type":"change-merged","change":{"project":"acme/widgets"}}`
+	changes := `{"type":"ref-updated","refUpdate":{"project":"acme/widgets","refName":"refs/changes/01/1/1"}}`
+	config := `{"type":"ref-updated","refUpdate":{"project":"acme/widgets","refName":"refs/meta/config"}}`
+	for _, tc := range []struct {
+		body      string
+		signature string
+		status    int
+	}{
+		{merged, "", http.StatusUnauthorized},
+		{merged, sign("wrong", merged), http.StatusUnauthorized},
+		{merged, sign("s3cret", changes), http.StatusUnauthorized},
+		{changes, sign("s3cret", changes), http.StatusNoContent},
+		{config, sign("s3cret", config), http.StatusNoContent},
+		{`{"type":"comment-added"}`, sign("s3cret", `{"type":"comment-added"}`), http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodPost, RouteGerritEvents, strings.NewReader(tc.body))
+		req.Header.Set("X-Gerrit-Signature-256", tc.signature)
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.body, tc.status, rec.Code)
+		}
+	}
+
+	rp = newReplicator(nil, GithubConfig{}, GerritConfig{}, nil)
+	req := httptest.NewRequest(http.MethodPost, RouteGerritEvents, strings.NewReader(`{}`))
+	req.Header.Set("X-Gerrit-Signature-256", sign("", `{}`))
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("events should be rejected when no secret is configured, got %d", rec.Code)
+	}
+}
+
+func TestReplicatorSkipsLegacyRepositories(t *testing.T) {
+	db := newTestDB(t)
+	imported := datastore.Repository{OrganizationID: "acme", Name: "widgets", GerritProject: "acme/widgets",
+		GithubCloneURL: "https://github.com/acme/widgets.git", Status: datastore.RepositoryImported}
+	legacy := datastore.Repository{OrganizationID: "acme", Name: "gadgets", GerritProject: "gadgets", Status: datastore.RepositoryLegacy}
+	for _, repo := range []*datastore.Repository{&imported, &legacy} {
+		if err := datastore.InsertRepository(db, repo); err != nil {
+			t.Fatalf("failed to insert repository: %v", err)
+		}
+	}
+	rp := newReplicator(db, GithubConfig{}, GerritConfig{EventsSecret: "s3cret"}, nil)
+
+	if err := rp.Enqueue(&legacy); err == nil {
+		t.Errorf("legacy repositories (without a clone URL) should not be replicated")
+	}
+	for project, status := range map[string]int{"acme/widgets": http.StatusAccepted, "gadgets": http.StatusNoContent} {
+		body := `{"type":"change-merged","change":{"project":"` + project + `"}}`
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(body))
+		req := httptest.NewRequest(http.MethodPost, RouteGerritEvents, strings.NewReader(body))
+		req.Header.Set("X-Gerrit-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", project, status, rec.Code)
+		}
+	}
+}
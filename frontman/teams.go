@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// TeamMapping maps a Github team to the Gerrit group its members are placed in
+type TeamMapping struct {
+	Org   string
+	Team  string // team slug
+	Group string // gerrit group name
+}
+
+// LoginHook is a func that is run (in order) whenever a user logs in, after their token has been verified and
+// their user record saved. A hook returning an error fails the login.
+type LoginHook func(ctx context.Context, tok *oauth2.Token, ident *Identity, user *datastore.User) error
+
+// teamSyncer keeps the Gerrit group memberships of users in line with their Github team memberships. Only the
+// groups that appear in the mappings are managed, other groups are left alone.
+type teamSyncer struct {
+	githubCfg GithubConfig
+	gerritCfg GerritConfig
+	mappings  []TeamMapping
+}
+
+// newTeamSyncer returns a teamSyncer for the mappings in the gerrit config
+func newTeamSyncer(githubCfg GithubConfig, gerritCfg GerritConfig) *teamSyncer {
+	return &teamSyncer{
+		githubCfg: githubCfg,
+		gerritCfg: gerritCfg,
+		mappings:  gerritCfg.TeamGroups,
+	}
+}
+
+// OnLogin is a LoginHook that syncs the users group memberships. Failures are logged, but do not prevent the
+// login (the groups will be synced on the next login).
+func (s *teamSyncer) OnLogin(ctx context.Context, tok *oauth2.Token, ident *Identity, user *datastore.User) error {
+	if ident.Provider != ProviderGithub || len(s.mappings) <= 0 || user.GerritAccountID == 0 {
+		return nil // the gerrit account (with the users login) may not be theirs unless it is linked
+	}
+	if err := s.Sync(ctx, tok, user); err != nil {
+		log.Println("Failed to sync gerrit groups for", user.Username, ":", err)
+	}
+	return nil
+}
+
+// Sync adds the (linked gerrit account of the) user to the groups mapped from the Github teams they are in, and
+// removes them from the mapped groups of teams they are not in.
+func (s *teamSyncer) Sync(ctx context.Context, tok *oauth2.Token, user *datastore.User) error {
+	tc := oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok.AccessToken}))
+	client, err := s.githubCfg.NewClient(tc)
+	if err != nil {
+		return err
+	}
+
+	// gather the users teams (as org/slug)
+	teams, err := listUserTeams(client)
+	if err != nil {
+		return err
+	}
+
+	// figure out which of the managed groups they belong in
+	wanted := map[string]bool{}
+	for _, m := range s.mappings {
+		wanted[m.Group] = wanted[m.Group] || inTeam(teams, m.Org, m.Team)
+	}
+
+	gclt, err := s.gerritCfg.NewClient()
+	if err != nil {
+		return errors.Wrap(err, "failed to setup client to gerrit server")
+	}
+	account := strconv.Itoa(user.GerritAccountID)
+	current, resp, err := gclt.Accounts.ListGroups(account)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		log.Println("No gerrit account for", user.Username, ", skipping group sync")
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to list gerrit groups")
+	}
+	isMember := map[string]bool{}
+	for _, group := range *current {
+		isMember[group.Name] = true
+	}
+
+	for group, want := range wanted {
+		switch {
+		case want && !isMember[group]:
+			log.Println("Adding", user.Username, "to gerrit group", group)
+			if _, _, err := gclt.Groups.AddGroupMember(group, account); err != nil {
+				return errors.Wrapf(err, "failed to add %s to gerrit group %s", user.Username, group)
+			}
+		case !want && isMember[group]:
+			log.Println("Removing", user.Username, "from gerrit group", group)
+			if _, err := gclt.Groups.DeleteGroupMember(group, account); err != nil {
+				return errors.Wrapf(err, "failed to remove %s from gerrit group %s", user.Username, group)
+			}
+		}
+	}
+	return nil
+}
+
+// listUserTeams returns the Github teams (as org/slug) of the user the client acts as
+func listUserTeams(client *github.Client) ([]string, error) {
+	teams := []string{}
+	opt := github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Organizations.ListUserTeams(&opt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list github teams")
+		}
+		for _, team := range page {
+			if team.Organization == nil || team.Organization.Login == nil || team.Slug == nil {
+				continue
+			}
+			teams = append(teams, *team.Organization.Login+"/"+*team.Slug)
+		}
+		if resp.NextPage == 0 {
+			return teams, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// inTeam returns true if the teams (as org/slug) include the team of the org. Github org logins and team slugs
+// are case insensitive, the configured ones need not match the case Github reports.
+func inTeam(teams []string, org, team string) bool {
+	for _, t := range teams {
+		parts := strings.SplitN(t, "/", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], org) && strings.EqualFold(parts[1], team) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTeamMappings parses the comma separated list of org/team=group entries
+func parseTeamMappings(val string) ([]TeamMapping, error) {
+	mappings := []TeamMapping{}
+	for _, entry := range strings.Split(val, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		eq := strings.Index(entry, "=")
+		slash := strings.Index(entry, "/")
+		if eq < 0 || slash < 0 || slash > eq {
+			return nil, errors.Errorf("invalid team mapping (want org/team=group): %s", entry)
+		}
+		mapping := TeamMapping{
+			Org:   strings.TrimSpace(entry[:slash]),
+			Team:  strings.TrimSpace(entry[slash+1 : eq]),
+			Group: strings.TrimSpace(entry[eq+1:]),
+		}
+		if mapping.Org == "" || mapping.Team == "" || mapping.Group == "" {
+			return nil, errors.Errorf("invalid team mapping (empty org, team or group): %s", entry)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
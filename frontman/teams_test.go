@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"golang.org/x/oauth2"
+)
+
+func TestParseTeamMappings(t *testing.T) {
+	tests := []struct {
+		val  string
+		want []TeamMapping
+	}{
+		{"", []TeamMapping{}},
+		{"acme/devs=developers", []TeamMapping{{Org: "acme", Team: "devs", Group: "developers"}}},
+		{" acme/devs = developers , acme/ops=operators,", []TeamMapping{
+			{Org: "acme", Team: "devs", Group: "developers"},
+			{Org: "acme", Team: "ops", Group: "operators"},
+		}},
+		{"acme/devs=team/x=y", []TeamMapping{{Org: "acme", Team: "devs", Group: "team/x=y"}}},
+		{"acme/devs", nil},
+		{"developers=acme/devs", nil},
+		{"acme/=developers", nil},
+		{"/devs=developers", nil},
+		{"acme/devs=", nil},
+		{"acme/ =developers", nil},
+		{"acme/devs=developers,acme/ops=", nil},
+	}
+	for _, tc := range tests {
+		got, err := parseTeamMappings(tc.val)
+		if (err == nil) != (tc.want != nil) {
+			t.Errorf("%q: unexpected error: %v", tc.val, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: expected %+v, got %+v", tc.val, tc.want, got)
+		}
+	}
+}
+
+func TestTeamSync(t *testing.T) {
+	// the user is in the devs team of the Acme org (as Github spells it)
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/user/teams" || r.Header.Get("Authorization") != "Bearer user-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"slug": "devs", "organization": map[string]interface{}{"login": "Acme"}},
+		})
+	}))
+	defer github.Close()
+	gerrit := newFakeGerrit()
+	srv := httptest.NewServer(gerrit)
+	defer srv.Close()
+	gerrit.groups["1000"] = []map[string]interface{}{
+		{"id": "global:Registered-Users", "name": "Registered Users"},
+		{"id": "operators-uuid", "name": "operators"},
+		{"id": "admins-uuid", "name": "admins"}, // not managed
+	}
+
+	s := newTeamSyncer(GithubConfig{URL: github.URL}, GerritConfig{
+		Addr:     srv.URL,
+		Username: "admin",
+		Password: "secret",
+		TeamGroups: []TeamMapping{
+			{Org: "acme", Team: "devs", Group: "developers"},
+			{Org: "acme", Team: "ops", Group: "operators"},
+		},
+	})
+	user := datastore.User{Username: "mona", GerritAccountID: 1000}
+	if err := s.Sync(context.Background(), &oauth2.Token{AccessToken: "user-token"}, &user); err != nil {
+		t.Fatalf("failed to sync teams: %v", err)
+	}
+
+	want := []string{"DELETE /groups/operators/members/1000", "PUT /groups/developers/members/1000"}
+	got := gerrit.changes()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected changes %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"goji.io/pat"
+	"golang.org/x/oauth2"
+)
+
+// API tokens are issued by frontman (to logged in users) for use by automation. They are presented as
+// "Authorization: Bearer <token>" and act with the upstream token of the session that created them, whose
+// memberships are verified (again) whenever the API token is used.
+const (
+	// RouteTokens is used to create and list API tokens
+	RouteTokens = "/tokens"
+	// RouteToken is used to revoke an API token
+	RouteToken = "/tokens/:id"
+
+	// ScopeRead allows safe (GET/HEAD) requests
+	ScopeRead = "read"
+	// ScopeWrite allows all other requests
+	ScopeWrite = "write"
+
+	// apiTokenPrefix identifies frontman issued tokens (as opposed to provider personal access tokens)
+	apiTokenPrefix = "polly_"
+	// apiTokenSealName is what the upstream token of API tokens is sealed for (like a cookie name)
+	apiTokenSealName = "api-token"
+	// defaultAPITokenMaxTTL is the default for AuthConfig.APITokenMaxTTL
+	defaultAPITokenMaxTTL = 90 * 24 * time.Hour
+)
+
+var (
+	// errInvalidAPIToken is returned when the bearer token is unknown, expired or revoked
+	errInvalidAPIToken = errors.New("invalid or expired API token")
+	// errInsufficientScope is returned when the API token lacks the scope required by the request
+	errInsufficientScope = errors.New("API token lacks the required scope")
+)
+
+// createAPITokenRequest is the body of a request to create an API token
+type createAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// createAPITokenResponse is returned when an API token is created. It is the only time the token is shown.
+type createAPITokenResponse struct {
+	datastore.APIToken
+	Token string `json:"token"`
+}
+
+// registerTokenRoutes adds the API token routes to the auth mux, behind the authentication middleware
+func (a *authRouter) registerTokenRoutes(authn *authenticator) {
+	a.mux.Handle(pat.Post(RouteTokens), authn.Middleware(http.HandlerFunc(a.HandleCreateAPIToken)))
+	a.mux.Handle(pat.Get(RouteTokens), authn.Middleware(http.HandlerFunc(a.HandleListAPITokens)))
+	a.mux.Handle(pat.Delete(RouteToken), authn.Middleware(http.HandlerFunc(a.HandleRevokeAPIToken)))
+}
+
+// HandleCreateAPIToken issues a new API token for the logged in user. Tokens can only be created from a
+// browser session (not using another API token).
+func (a *authRouter) HandleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return
+	}
+	if apiTokenFromRequest(r) != "" {
+		handleForbidden(w, "API tokens can only be created from a browser session")
+		return
+	}
+
+	body := createAPITokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		handleJSONDecodeError(w, err)
+		return
+	}
+	if body.Name == "" {
+		handleMissingParam(w, errors.New("missing token name"))
+		return
+	}
+	if len(body.Scopes) == 0 {
+		body.Scopes = []string{ScopeRead}
+	}
+	for _, scope := range body.Scopes {
+		if scope != ScopeRead && scope != ScopeWrite {
+			handleMissingParam(w, errors.Errorf("unknown scope: %s", scope))
+			return
+		}
+	}
+
+	secret, err := generateAPIToken()
+	if err != nil {
+		handleInternalError(w, err)
+		return
+	}
+	ttl := a.apiTokenMaxTTL()
+	if body.ExpiresInDays < 0 || time.Duration(body.ExpiresInDays)*24*time.Hour > ttl {
+		handleMissingParam(w, errors.Errorf("tokens may be valid for at most %d days", int(ttl.Hours()/24)))
+		return
+	} else if body.ExpiresInDays > 0 {
+		ttl = time.Duration(body.ExpiresInDays) * 24 * time.Hour
+	}
+	sealed, err := a.sessionSealer.Seal(apiTokenSealName, []byte(ident.Token.AccessToken))
+	if err != nil {
+		handleInternalError(w, err)
+		return
+	}
+	expiry := time.Now().Add(ttl)
+	token := datastore.APIToken{
+		UserID:      ident.User.ID,
+		Name:        body.Name,
+		Hash:        hashAPIToken(secret),
+		Scopes:      strings.Join(body.Scopes, ","),
+		AccessToken: sealed,
+		ExpiresAt:   &expiry,
+	}
+	if err := datastore.InsertAPIToken(a.db, &token); err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to store API token"))
+		return
+	}
+
+	log.Printf("[TOKENS] Issued API token %d (%s) for user %d", token.ID, token.Name, token.UserID)
+	gores.JSON(w, http.StatusCreated, createAPITokenResponse{APIToken: token, Token: secret})
+}
+
+// HandleListAPITokens lists the API tokens issued to the authenticated user
+func (a *authRouter) HandleListAPITokens(w http.ResponseWriter, r *http.Request) {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return
+	}
+	tokens, err := datastore.ListAPITokensForUser(a.db, ident.User.ID)
+	if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to list API tokens"))
+		return
+	}
+	gores.JSON(w, http.StatusOK, tokens)
+}
+
+// HandleRevokeAPIToken revokes one of the API tokens issued to the authenticated user
+func (a *authRouter) HandleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return
+	}
+	id, err := strconv.ParseUint(pat.Param(r, "id"), 10, 64)
+	if err != nil {
+		handleMissingParam(w, errors.Wrap(err, "invalid token ID"))
+		return
+	}
+	err = datastore.RevokeAPIToken(a.db, ident.User.ID, uint(id), time.Now())
+	if err == gorm.ErrRecordNotFound {
+		gores.JSON(w, http.StatusNotFound, errorResponseBody{Error: "no such token"})
+		return
+	} else if err != nil {
+		handleInternalError(w, errors.Wrap(err, "failed to revoke API token"))
+		return
+	}
+	log.Printf("[TOKENS] Revoked API token %d for user %d", id, ident.User.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// - - - Helpers - - -
+//
+
+// getAPITokenState returns the state associated with the API token presented in the request, provided it
+// grants the scope the request needs and its upstream token is (still) admitted by the identity provider. The
+// returned bool is false if the request carries no API token.
+func (a *authRouter) getAPITokenState(r *http.Request) (sessionState, bool, error) {
+	secret := apiTokenFromRequest(r)
+	if secret == "" {
+		return sessionState{}, false, nil
+	}
+
+	now := time.Now()
+	token, err := datastore.FindActiveAPIToken(a.db, hashAPIToken(secret), now)
+	if err == gorm.ErrRecordNotFound {
+		return sessionState{}, true, errInvalidAPIToken
+	} else if err != nil {
+		return sessionState{}, true, errors.Wrap(err, "failed to lookup API token")
+	}
+	if !hasScope(token.Scopes, requiredScope(r)) {
+		return sessionState{}, true, errInsufficientScope
+	}
+	upstream, err := a.sessionSealer.Open(apiTokenSealName, token.AccessToken)
+	if err != nil {
+		log.Println("[TOKENS] Failed to open upstream token of API token", token.ID, ":", err)
+		return sessionState{}, true, errInvalidAPIToken
+	}
+	// the memberships are verified (with caching) on every use, so that users who left the org lose access
+	ident, err := a.VerifyAuthToken(oauth2.Token{AccessToken: string(upstream)})
+	if err != nil {
+		log.Println("[TOKENS] Upstream token of API token", token.ID, "is no longer admitted:", err)
+		return sessionState{}, true, errInvalidAPIToken
+	}
+	if err := datastore.TouchAPIToken(a.db, token.ID, now); err != nil {
+		log.Println("[TOKENS] Failed to record API token use:", err)
+	}
+
+	state := sessionState{
+		UserID:      token.UserID,
+		OAuth2Token: oauth2.Token{AccessToken: string(upstream)},
+		Memberships: ident.Memberships,
+	}
+	if token.ExpiresAt != nil {
+		state.ExpiresAt = *token.ExpiresAt
+	}
+	return state, true, nil
+}
+
+// apiTokenMaxTTL returns the longest an API token may be valid for
+func (a *authRouter) apiTokenMaxTTL() time.Duration {
+	if a.authConfig.APITokenMaxTTL <= 0 {
+		return defaultAPITokenMaxTTL
+	}
+	return a.authConfig.APITokenMaxTTL
+}
+
+// requiredScope returns the scope an API token needs to make the request
+func requiredScope(r *http.Request) string {
+	if isSafeMethod(r.Method) {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// hasScope returns true if the (comma separated) scopes include the wanted one. Write implies read.
+func hasScope(scopes, want string) bool {
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope == want || scope == ScopeWrite {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenFromRequest returns the frontman API token from the Authorization header (if any)
+func apiTokenFromRequest(r *http.Request) string {
+	hdr := r.Header.Get("Authorization")
+	if !strings.HasPrefix(hdr, "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(hdr, "Bearer "))
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return ""
+	}
+	return token
+}
+
+// generateAPIToken returns a new (random) API token
+func generateAPIToken() (string, error) {
+	rnd := make([]byte, 32)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", errors.Wrap(err, "failed to generate API token")
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(rnd), nil
+}
+
+// hashAPIToken returns the hash of the token, which is what gets stored
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/pkg/errors"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/oauth2"
+)
+
+func TestAPITokenScopes(t *testing.T) {
+	tests := []struct {
+		method string
+		scopes string
+		ok     bool
+	}{
+		{"GET", "read", true},
+		{"HEAD", "read", true},
+		{"PUT", "read", false},
+		{"POST", "read,write", true},
+		{"GET", "write", true},
+		{"DELETE", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/gerrit/repositories/foo", nil)
+		if got := hasScope(tt.scopes, requiredScope(r)); got != tt.ok {
+			t.Errorf("%s with scopes %q: expected %v, got %v", tt.method, tt.scopes, tt.ok, got)
+		}
+	}
+}
+
+func TestAPITokenFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer gho_notours")
+	if tok := apiTokenFromRequest(r); tok != "" {
+		t.Errorf("provider tokens should not be treated as API tokens, got %q", tok)
+	}
+
+	tok, err := generateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+tok)
+	if got := apiTokenFromRequest(r); got != tok {
+		t.Errorf("expected %q, got %q", tok, got)
+	}
+	if hashAPIToken(tok) == tok {
+		t.Errorf("token should not be stored in the clear")
+	}
+}
+
+// fakeProvider is an IdentityProvider that admits the holders of the tokens in members
+type fakeProvider struct {
+	IdentityProvider
+	members map[string][]Membership // token -> memberships
+}
+
+func (p fakeProvider) Identity(ctx context.Context, tok *oauth2.Token) (*Identity, error) {
+	return &Identity{Provider: "fake", Login: tok.AccessToken}, nil
+}
+
+func (p fakeProvider) CheckMembership(ctx context.Context, tok *oauth2.Token, ident *Identity) ([]Membership, error) {
+	mems, ok := p.members[tok.AccessToken]
+	if !ok {
+		return nil, errors.New("not a member")
+	}
+	return mems, nil
+}
+
+func TestAPITokenState(t *testing.T) {
+	db := newTestDB(t)
+	sealer, err := newCookieSealer([][]byte{[]byte("session-key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := fakeProvider{members: map[string][]Membership{"member-token": {{Org: "acme", Role: RoleMember}}}}
+	a := &authRouter{
+		db:            db,
+		provider:      provider,
+		sessionSealer: sealer,
+		verifyCache:   newVerificationCache(time.Minute, time.Minute),
+	}
+
+	// issue returns the API token (acting with the upstream token) that was stored
+	issue := func(upstream string, seal bool) string {
+		secret, err := generateAPIToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := upstream
+		if seal {
+			if stored, err = sealer.Seal(apiTokenSealName, []byte(upstream)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		token := datastore.APIToken{UserID: 1, Hash: hashAPIToken(secret), Scopes: ScopeRead, AccessToken: stored}
+		if err := datastore.InsertAPIToken(db, &token); err != nil {
+			t.Fatalf("failed to insert API token: %v", err)
+		}
+		return secret
+	}
+	stateOf := func(secret string) (sessionState, error) {
+		r := httptest.NewRequest("GET", "/gerrit/imports", nil)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		state, _, err := a.getAPITokenState(r)
+		return state, err
+	}
+
+	state, err := stateOf(issue("member-token", true))
+	if err != nil {
+		t.Fatalf("expected token of member to be accepted: %v", err)
+	}
+	if state.OAuth2Token.AccessToken != "member-token" || !reflect.DeepEqual(state.Memberships, provider.members["member-token"]) {
+		t.Errorf("expected the upstream token and its current memberships, got %+v", state)
+	}
+
+	if _, err := stateOf(issue("leaver-token", true)); err != errInvalidAPIToken {
+		t.Errorf("expected token of user who left the org to be rejected, got %v", err)
+	}
+	if _, err := stateOf(issue("member-token", false)); err != errInvalidAPIToken {
+		t.Errorf("expected token with an unsealed upstream token to be rejected, got %v", err)
+	}
+}
+
+func TestAPITokenRoutes(t *testing.T) {
+	db := newTestDB(t)
+	sealer, err := newCookieSealer([][]byte{[]byte("session-key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authRouter{
+		mux:           goji.SubMux(),
+		db:            db,
+		provider:      fakeProvider{members: map[string][]Membership{"member-token": {{Org: "acme", Role: RoleMember}}}},
+		sessionSealer: sealer,
+		verifyCache:   newVerificationCache(time.Minute, time.Minute),
+	}
+	a.registerTokenRoutes(newAuthenticator(a, GithubConfig{}, AuthConfig{Provider: "fake"}))
+	mux := goji.NewMux()
+	mux.Handle(pat.New("/auth/*"), a)
+
+	now := time.Now()
+	member := datastore.User{Username: "member"}
+	leaver := datastore.User{Username: "leaver", OffboardedAt: &now}
+	for _, user := range []*datastore.User{&member, &leaver} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatalf("failed to insert user: %v", err)
+		}
+	}
+	// issue returns an API token of the user (acting with the token of a member)
+	issue := func(user datastore.User, scopes string) string {
+		secret, err := generateAPIToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := sealer.Seal(apiTokenSealName, []byte("member-token"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := datastore.APIToken{UserID: user.ID, Hash: hashAPIToken(secret), Scopes: scopes, AccessToken: sealed}
+		if err := datastore.InsertAPIToken(db, &token); err != nil {
+			t.Fatalf("failed to insert API token: %v", err)
+		}
+		return secret
+	}
+	reader, writer := issue(member, ScopeRead), issue(member, "read,write")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"list", "GET", "/auth/tokens", reader, http.StatusOK},
+		{"list unauthenticated", "GET", "/auth/tokens", "", http.StatusUnauthorized},
+		{"list offboarded", "GET", "/auth/tokens", issue(leaver, ScopeRead), http.StatusForbidden},
+		{"create with API token", "POST", "/auth/tokens", writer, http.StatusForbidden},
+		{"revoke without write scope", "DELETE", "/auth/tokens/1", reader, http.StatusForbidden},
+		{"revoke unknown", "DELETE", "/auth/tokens/999", writer, http.StatusNotFound},
+		{"revoke", "DELETE", "/auth/tokens/1", writer, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tt.token))
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("expected %d, got %d: %s", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
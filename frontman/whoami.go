@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/amoghe/polly/frontman/datastore"
+)
+
+// RouteWhoami returns the profile (and provisioning status) of the logged in user
+const RouteWhoami = "/auth/whoami"
+
+// whoamiResponse describes the logged in user. Details that could not be looked up (upstream) are omitted.
+type whoamiResponse struct {
+	Provider         string        `json:"provider"`
+	Login            string        `json:"login"`
+	Name             string        `json:"name"`
+	Email            string        `json:"email"`
+	AvatarURL        string        `json:"avatar_url,omitempty"`
+	Orgs             []Membership  `json:"orgs"`
+	Teams            []string      `json:"teams,omitempty"`
+	Gerrit           gerritProfile `json:"gerrit"`
+	SessionExpiresAt *time.Time    `json:"session_expires_at,omitempty"`
+	LastLoginAt      time.Time     `json:"last_login_at"`
+}
+
+// gerritProfile describes the gerrit account linked to the user
+type gerritProfile struct {
+	Provisioned bool     `json:"provisioned"`
+	AccountID   int      `json:"account_id,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+}
+
+// whoamiHandler serves the whoami route. It must be wrapped by the authentication middleware.
+type whoamiHandler struct {
+	auth      AuthenticatingRouter
+	gerritCfg GerritConfig
+}
+
+// newWhoamiHandler returns a handler for the whoami route
+func newWhoamiHandler(auth AuthenticatingRouter, gerritCfg GerritConfig) http.Handler {
+	return &whoamiHandler{
+		auth:      auth,
+		gerritCfg: gerritCfg,
+	}
+}
+
+// ServeHTTP responds with the profile of the logged in user
+func (h *whoamiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ident, err := IdentityFromRequest(r)
+	if err != nil {
+		handleSessionExtractError(w, err)
+		return
+	}
+
+	resp := whoamiResponse{
+		Login:       ident.User.Username,
+		Name:        ident.User.Name,
+		Email:       ident.User.Email,
+		Orgs:        ident.Memberships,
+		LastLoginAt: ident.User.LastLoginAt,
+	}
+	if !ident.ExpiresAt.IsZero() {
+		resp.SessionExpiresAt = &ident.ExpiresAt
+	}
+
+	if upstream, err := h.auth.VerifyAuthToken(*ident.Token); err != nil {
+		log.Println("[WHOAMI] Failed to lookup identity of", ident.User.Username, ":", err)
+	} else {
+		resp.Provider = upstream.Provider
+		resp.Login = upstream.Login
+		resp.AvatarURL = upstream.AvatarURL
+	}
+
+	if ident.Github != nil {
+		if teams, err := listUserTeams(ident.Github); err != nil {
+			log.Println("[WHOAMI] Failed to list teams of", ident.User.Username, ":", err)
+		} else {
+			resp.Teams = admittedTeams(teams, ident.Memberships)
+		}
+	}
+
+	resp.Gerrit = h.gerritProfile(ident.User)
+	gores.JSON(w, http.StatusOK, resp)
+}
+
+// gerritProfile looks up the gerrit account (and its groups) linked to the user
+func (h *whoamiHandler) gerritProfile(user *datastore.User) gerritProfile {
+	if user.GerritAccountID == 0 {
+		return gerritProfile{}
+	}
+	profile := gerritProfile{Provisioned: true, AccountID: user.GerritAccountID}
+
+	gclt, err := h.gerritCfg.NewClient()
+	if err != nil {
+		log.Println("[WHOAMI] Failed to setup client to gerrit server:", err)
+		return profile
+	}
+	groups, _, err := gclt.Accounts.ListGroups(strconv.Itoa(user.GerritAccountID))
+	if err != nil {
+		log.Println("[WHOAMI] Failed to list gerrit groups of", user.Username, ":", err)
+		return profile
+	}
+	for _, group := range *groups {
+		profile.Groups = append(profile.Groups, group.Name)
+	}
+	return profile
+}
+
+// admittedTeams returns the teams (as org/slug) that belong to the orgs that admitted the user. Github org
+// names are case insensitive, the configured ones need not match the case Github reports.
+func admittedTeams(teams []string, mems []Membership) []string {
+	ret := []string{}
+	for _, team := range teams {
+		org := strings.SplitN(team, "/", 2)[0]
+		for _, mem := range mems {
+			if org != team && strings.EqualFold(org, mem.Org) {
+				ret = append(ret, team)
+				break
+			}
+		}
+	}
+	return ret
+}
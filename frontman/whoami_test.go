@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amoghe/polly/frontman/datastore"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// fakeWhoamiAuth authenticates requests (carrying a session cookie or an API token) as the given identity,
+// whose upstream identity is upstream (or fails to verify if that is nil)
+type fakeWhoamiAuth struct {
+	fakeAuthRouter
+	upstream *Identity
+}
+
+func (f fakeWhoamiAuth) Authenticate(r *http.Request) (*RequestIdentity, error) {
+	if r.Header.Get("Authorization") != "" {
+		return f.ident, nil
+	}
+	return f.fakeAuthRouter.Authenticate(r)
+}
+
+func (f fakeWhoamiAuth) VerifyAuthToken(tok oauth2.Token) (*Identity, error) {
+	if f.upstream == nil {
+		return nil, errors.New("token revoked")
+	}
+	return f.upstream, nil
+}
+
+func TestHandleWhoami(t *testing.T) {
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/user/teams" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"slug": "devs", "organization": map[string]interface{}{"login": "Acme"}},
+			{"slug": "secret", "organization": map[string]interface{}{"login": "elsewhere"}},
+		})
+	}))
+	defer github.Close()
+	gerrit := newFakeGerrit()
+	srv := httptest.NewServer(gerrit)
+	defer srv.Close()
+	gerrit.groups["1000"] = []map[string]interface{}{{"id": "developers-uuid", "name": "developers"}}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	linked := &datastore.User{ID: 1, Username: "mona", Name: "Mona", GerritAccountID: 1000}
+	mems := []Membership{{Org: "acme", Role: RoleMember}}
+
+	tests := []struct {
+		name     string
+		provider string
+		apiToken bool
+		user     *datastore.User
+		upstream *Identity
+		want     whoamiResponse
+	}{
+		{
+			name:     "github session",
+			provider: ProviderGithub,
+			user:     linked,
+			upstream: &Identity{Provider: ProviderGithub, Login: "octocat", AvatarURL: "https://avatars/1"},
+			want: whoamiResponse{
+				Provider:  ProviderGithub,
+				Login:     "octocat",
+				Name:      "Mona",
+				AvatarURL: "https://avatars/1",
+				Orgs:      mems,
+				Teams:     []string{"Acme/devs"},
+				Gerrit:    gerritProfile{Provisioned: true, AccountID: 1000, Groups: []string{"developers"}},
+			},
+		},
+		{
+			name:     "gitlab session, not provisioned",
+			provider: ProviderGitlab,
+			user:     &datastore.User{ID: 2, Username: "tanuki"},
+			upstream: &Identity{Provider: ProviderGitlab, Login: "tanuki"},
+			want:     whoamiResponse{Provider: ProviderGitlab, Login: "tanuki", Orgs: mems},
+		},
+		{
+			name:     "api token, upstream unavailable",
+			provider: ProviderGithub,
+			apiToken: true,
+			user:     linked,
+			want: whoamiResponse{
+				Login:  "mona",
+				Name:   "Mona",
+				Orgs:   mems,
+				Teams:  []string{"Acme/devs"},
+				Gerrit: gerritProfile{Provisioned: true, AccountID: 1000, Groups: []string{"developers"}},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ident := &RequestIdentity{
+				User:        tc.user,
+				Memberships: mems,
+				Token:       &oauth2.Token{AccessToken: "upstream-token"},
+				ExpiresAt:   expires,
+			}
+			auth := fakeWhoamiAuth{fakeAuthRouter: fakeAuthRouter{ident: ident}, upstream: tc.upstream}
+			authn := newAuthenticator(auth, GithubConfig{URL: github.URL}, AuthConfig{Provider: tc.provider})
+			gerritCfg := GerritConfig{Addr: srv.URL, Username: "admin", Password: "secret"}
+			handler := authn.Middleware(newWhoamiHandler(auth, gerritCfg))
+
+			r := httptest.NewRequest("GET", RouteWhoami, nil)
+			if tc.apiToken {
+				r.Header.Set("Authorization", "Bearer frontman-token")
+			} else {
+				r.AddCookie(&http.Cookie{Name: sessionCookieMaker.Name, Value: "x"})
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+			}
+
+			var got whoamiResponse
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if got.SessionExpiresAt == nil || !got.SessionExpiresAt.Equal(expires) {
+				t.Errorf("expected session expiry %v, got %v", expires, got.SessionExpiresAt)
+			}
+			got.SessionExpiresAt, got.LastLoginAt = nil, time.Time{}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+
+	// unauthenticated callers never reach the handler
+	handler := newAuthenticator(fakeWhoamiAuth{}, GithubConfig{}, AuthConfig{}).
+		Middleware(newWhoamiHandler(fakeWhoamiAuth{}, GerritConfig{}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", RouteWhoami, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated request to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAdmittedTeams(t *testing.T) {
+	teams := []string{"Acme/devs", "acme/ops", "acme-corp/devs", "elsewhere/secret", "acme"}
+	mems := []Membership{{Org: "ACME", Role: RoleMember}}
+	want := []string{"Acme/devs", "acme/ops"}
+	if got := admittedTeams(teams, mems); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got := admittedTeams(teams, nil); len(got) != 0 {
+		t.Errorf("expected no teams without memberships, got %q", got)
+	}
+}